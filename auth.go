@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/term"
+)
+
+const envAuthSock = "SSH_AUTH_SOCK"
+
+// defaultIdentityFiles are tried when no -i flag is given, in the same order
+// OpenSSH uses.
+var defaultIdentityFiles = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// authMethods builds the list of authentication methods offered to the
+// server. Like OpenSSH, public keys (agent first, then identity files) are
+// tried first, then keyboard-interactive and finally the password. Servers
+// that demand several methods in a row (e.g. publickey followed by an OTP)
+// are handled by the ssh package, which keeps going after partial success.
+// Without interactive, keyboard-interactive only answers password prompts.
+//
+// The keys are gathered when the server asks for them, so nothing is loaded
+// for hosts that never get to publickey authentication.
+func authMethods(keys *identities, identityFiles []string, password string, interactive bool) []ssh.AuthMethod {
+	var methods []ssh.AuthMethod
+
+	// The ssh package never tries the same method twice, so all keys have to
+	// be offered through a single publickey method.
+	if keys.available(identityFiles) {
+		methods = append(methods, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			return keys.signers(identityFiles, interactive), nil
+		}))
+	}
+
+	if password != "" || (interactive && term.IsTerminal(int(syscall.Stdin))) {
+		methods = append(methods, ssh.KeyboardInteractive(keyboardInteractive(password, interactive)))
+	}
+
+	if password != "" {
+		methods = append(methods, ssh.Password(password))
+	}
+
+	return methods
+}
+
+// keyboardInteractive answers server challenges on the terminal. Answers to
+// prompts that must not be echoed are read the same way as the password. An
+// already known password is used for the first password prompt instead of
+// asking for it again.
+func keyboardInteractive(password string, interactive bool) ssh.KeyboardInteractiveChallenge {
+	passwordUsed := password == ""
+
+	return func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		if name != "" {
+			fmt.Println(name)
+		}
+		if instruction != "" {
+			fmt.Println(instruction)
+		}
+
+		answers := make([]string, len(questions))
+		for i, question := range questions {
+			if !passwordUsed && !echos[i] && isPasswordPrompt(question) {
+				passwordUsed = true
+				answers[i] = password
+				continue
+			}
+
+			if !interactive || !term.IsTerminal(int(syscall.Stdin)) {
+				return nil, fmt.Errorf("cannot answer '%s' without a terminal", question)
+			}
+
+			var err error
+			if echos[i] {
+				answers[i], err = readLine(question)
+			} else {
+				answers[i], err = readSecret(question)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return answers, nil
+	}
+}
+
+func isPasswordPrompt(question string) bool {
+	return strings.Contains(strings.ToLower(question), "password")
+}
+
+// readLine prints the prompt and reads a line from the terminal with echo on.
+func readLine(prompt string) (string, error) {
+	fmt.Print(prompt)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(line), nil
+}
+
+// identities loads private keys at most once, so that jump hosts and the
+// server itself don't ask for the same passphrase again.
+type identities struct {
+	loaded map[string]ssh.Signer
+	mu     sync.Mutex
+
+	// agent is the connection to the SSH agent, kept open for the signers
+	// it handed out, which sign through it.
+	agent     agent.ExtendedAgent
+	agentConn net.Conn
+}
+
+func newIdentities() *identities {
+	return &identities{loaded: make(map[string]ssh.Signer)}
+}
+
+// available reports whether there may be keys to offer, without loading any.
+func (ids *identities) available(identityFiles []string) bool {
+	if os.Getenv(envAuthSock) != "" {
+		return true
+	}
+
+	if len(identityFiles) == 0 {
+		identityFiles = defaultIdentities()
+	}
+
+	for _, file := range identityFiles {
+		if _, err := os.Stat(file); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// signers gathers the signers from the SSH agent and identity files, in that
+// order. Keys that cannot be loaded are logged and skipped so that the
+// remaining methods still get a chance. The passphrase of an encrypted key is
+// only asked for once the server accepted the key, and only if interactive is
+// set.
+func (ids *identities) signers(identityFiles []string, interactive bool) []ssh.Signer {
+	ids.mu.Lock()
+	defer ids.mu.Unlock()
+
+	var signers []ssh.Signer
+
+	agentSigners, err := ids.agentSigners()
+	if err != nil {
+		log.Printf("ssh agent unavailable: %v", err)
+	}
+	signers = append(signers, agentSigners...)
+
+	explicit := len(identityFiles) > 0
+	if !explicit {
+		identityFiles = defaultIdentities()
+	}
+
+	for _, file := range identityFiles {
+		if signer, ok := ids.loaded[file]; ok {
+			signers = append(signers, signer)
+			continue
+		}
+
+		signer, err := ids.load(file, interactive)
+		if err != nil {
+			if !explicit && errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+
+			log.Printf("skipping identity '%s': %v", file, err)
+			continue
+		}
+
+		signers = append(signers, signer)
+	}
+
+	return signers
+}
+
+// load reads a private key. Encrypted keys are returned as an encryptedKey if
+// their public key is known, and are decrypted right away otherwise.
+func (ids *identities) load(file string, interactive bool) (ssh.Signer, error) {
+	pemBytes, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(pemBytes)
+
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		if err == nil {
+			ids.loaded[file] = signer
+		}
+
+		return signer, err
+	}
+
+	if !interactive {
+		return nil, err
+	}
+
+	pub := missing.PublicKey
+	if pub == nil {
+		pub = publicKeyFile(file + ".pub")
+	}
+	if pub != nil {
+		return &encryptedKey{ids: ids, file: file, pub: pub}, nil
+	}
+
+	signer, err = decrypt(file, pemBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	ids.loaded[file] = signer
+
+	return signer, nil
+}
+
+// publicKeyFile reads the public key next to a private key, as written by
+// ssh-keygen. It returns nil if there is none.
+func publicKeyFile(file string) ssh.PublicKey {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil
+	}
+
+	return pub
+}
+
+// encryptedKey is an encrypted identity that is decrypted when it is first
+// used for signing, i.e. once the server accepted its public key.
+type encryptedKey struct {
+	ids  *identities
+	file string
+	pub  ssh.PublicKey
+}
+
+func (k *encryptedKey) PublicKey() ssh.PublicKey {
+	return k.pub
+}
+
+func (k *encryptedKey) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return k.SignWithAlgorithm(rand, data, "")
+}
+
+func (k *encryptedKey) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	signer, err := k.signer()
+	if err != nil {
+		return nil, err
+	}
+
+	if as, ok := signer.(ssh.AlgorithmSigner); ok {
+		return as.SignWithAlgorithm(rand, data, algorithm)
+	}
+
+	if algorithm != "" && algorithm != k.pub.Type() {
+		return nil, fmt.Errorf("key '%s' cannot sign with %s", k.file, algorithm)
+	}
+
+	return signer.Sign(rand, data)
+}
+
+// signer decrypts the key, unless that already happened for another
+// connection.
+func (k *encryptedKey) signer() (ssh.Signer, error) {
+	k.ids.mu.Lock()
+	defer k.ids.mu.Unlock()
+
+	if signer, ok := k.ids.loaded[k.file]; ok {
+		return signer, nil
+	}
+
+	pemBytes, err := os.ReadFile(k.file)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := decrypt(k.file, pemBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt '%s': %w", k.file, err)
+	}
+
+	k.ids.loaded[k.file] = signer
+
+	return signer, nil
+}
+
+// agentSigners returns the keys of the SSH agent. The connection to the agent
+// is opened once and reused, unless it failed.
+func (ids *identities) agentSigners() ([]ssh.Signer, error) {
+	socket := os.Getenv(envAuthSock)
+	if socket == "" {
+		return nil, nil
+	}
+
+	if ids.agent == nil {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to %s: %v", socket, err)
+		}
+
+		ids.agent = agent.NewClient(conn)
+		ids.agentConn = conn
+	}
+
+	signers, err := ids.agent.Signers()
+	if err != nil {
+		ids.agentConn.Close()
+		ids.agent = nil
+		ids.agentConn = nil
+		return nil, err
+	}
+
+	return signers, nil
+}
+
+func defaultIdentities() []string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+
+	files := make([]string, len(defaultIdentityFiles))
+	for i, name := range defaultIdentityFiles {
+		files[i] = filepath.Join(home, ".ssh", name)
+	}
+
+	return files
+}
+
+// decrypt prompts for the passphrase of an encrypted key and parses it.
+func decrypt(file string, pemBytes []byte) (ssh.Signer, error) {
+	passphrase, err := readSecret(fmt.Sprintf("Enter passphrase for key '%s': ", file))
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.ParsePrivateKeyWithPassphrase(pemBytes, []byte(passphrase))
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// endpoint is a fully resolved SSH server, either a jump host or the server
+// that gets mounted.
+type endpoint struct {
+	alias         string
+	addr          string
+	user          string
+	proxyJump     string
+	hostKeys      *hostKeyChecker
+	identityFiles []string
+
+	serverAliveInterval time.Duration
+	serverAliveCountMax int
+}
+
+// connector holds the command line settings shared by every hop and turns
+// host aliases into endpoints.
+type connector struct {
+	sshCfg        *sshConfig
+	identities    *identities
+	identityFiles []string
+	knownHosts    string
+	password      string
+}
+
+// endpoint resolves alias through ssh_config. A zero port means the port from
+// ssh_config (or 22) is used. The first non-empty username wins, followed by
+// the configured User and the local user name.
+func (c *connector) endpoint(alias string, port int, usernames ...string) (*endpoint, error) {
+	hostCfg, err := c.sshCfg.resolve(alias)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve '%s': %v", alias, err)
+	}
+
+	if port == 0 {
+		port = hostCfg.port
+	}
+	if port == 0 {
+		port = defaultPort
+	}
+
+	username, err := getUsername(append(usernames, hostCfg.user)...)
+	if err != nil {
+		return nil, err
+	}
+
+	knownHostsFiles := []string{defaultKnownHosts()}
+	if c.knownHosts != "" {
+		knownHostsFiles = []string{c.knownHosts}
+	} else if len(hostCfg.knownHostsFiles) > 0 {
+		knownHostsFiles = existingFiles(hostCfg.knownHostsFiles)
+	}
+
+	hostKeys, err := newHostKeyChecker(knownHostsFiles...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up host key checking for '%s': %v", alias, err)
+	}
+
+	identityFiles := append(append([]string{}, c.identityFiles...), hostCfg.identityFiles...)
+	if len(c.authMethods(identityFiles, true)) == 0 {
+		return nil, fmt.Errorf(
+			"no authentication methods available for '%s': use -i, %s, -p or %s",
+			alias, envAuthSock, envPassword,
+		)
+	}
+
+	return &endpoint{
+		alias:         alias,
+		addr:          net.JoinHostPort(hostCfg.hostName, strconv.Itoa(port)),
+		user:          username,
+		proxyJump:     hostCfg.proxyJump,
+		hostKeys:      hostKeys,
+		identityFiles: identityFiles,
+
+		serverAliveInterval: hostCfg.serverAliveInterval,
+		serverAliveCountMax: hostCfg.serverAliveCountMax,
+	}, nil
+}
+
+// jumpHosts resolves a ProxyJump specification of the form
+// "[user@]host[:port],...". The value "none" disables jumping.
+func (c *connector) jumpHosts(spec string) ([]*endpoint, error) {
+	if spec == "" || strings.EqualFold(spec, "none") {
+		return nil, nil
+	}
+
+	var hops []*endpoint
+	for _, hop := range strings.Split(spec, ",") {
+		username, hostPort := parseTarget(strings.TrimPrefix(strings.TrimSpace(hop), "ssh://"))
+
+		host, port, err := splitHostPort(hostPort)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jump host '%s': %v", hop, err)
+		}
+
+		ep, err := c.endpoint(host, port, username)
+		if err != nil {
+			return nil, err
+		}
+
+		hops = append(hops, ep)
+	}
+
+	return hops, nil
+}
+
+// splitHostPort splits "host[:port]", returning a zero port if none is given.
+func splitHostPort(hostPort string) (string, int, error) {
+	if !strings.Contains(hostPort, ":") {
+		return hostPort, 0, nil
+	}
+
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return "", 0, err
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port '%s'", portStr)
+	}
+
+	return host, port, nil
+}
+
+// authMethods builds fresh authentication methods for one connection attempt,
+// since keyboard-interactive keeps track of the prompts it has answered.
+func (c *connector) authMethods(identityFiles []string, interactive bool) []ssh.AuthMethod {
+	return authMethods(c.identities, identityFiles, c.password, interactive)
+}
+
+// clientConfig returns the SSH configuration for one connection to hop.
+func (c *connector) clientConfig(hop *endpoint, interactive bool) *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User:              hop.user,
+		Auth:              c.authMethods(hop.identityFiles, interactive),
+		HostKeyCallback:   hop.hostKeys.HostKeyCallback(),
+		HostKeyAlgorithms: hop.hostKeys.HostKeyAlgorithms(hop.addr),
+	}
+}
+
+// dial connects to the last endpoint, tunnelling through every endpoint
+// before it. Each hop authenticates and verifies its host key on its own.
+// Unless interactive is set, nothing is asked on the terminal.
+func (c *connector) dial(hops []*endpoint, interactive bool) (*ssh.Client, error) {
+	var clients []*ssh.Client
+	closeAll := func() {
+		for i := len(clients) - 1; i >= 0; i-- {
+			clients[i].Close()
+		}
+	}
+
+	for _, hop := range hops {
+		client, err := dialHop(clients, hop, c.clientConfig(hop, interactive))
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+
+		clients = append(clients, client)
+	}
+
+	// The jump connections have to outlive the tunnel they carry, so they
+	// are closed once the final connection is gone.
+	go func() {
+		clients[len(clients)-1].Wait()
+		closeAll()
+	}()
+
+	return clients[len(clients)-1], nil
+}
+
+func dialHop(previous []*ssh.Client, hop *endpoint, config *ssh.ClientConfig) (*ssh.Client, error) {
+	if len(previous) == 0 {
+		client, err := ssh.Dial("tcp", hop.addr, config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to dial %v: %v", hop.addr, err)
+		}
+
+		return client, nil
+	}
+
+	jump := previous[len(previous)-1]
+	log.Printf("connecting to %v through %v", hop.addr, jump.RemoteAddr())
+
+	conn, err := jump.Dial("tcp", hop.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %v through %v: %v", hop.addr, jump.RemoteAddr(), err)
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, hop.addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to connect to %v: %v", hop.addr, err)
+	}
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
@@ -0,0 +1,54 @@
+package filesystem
+
+import (
+	"errors"
+	"os"
+	"sftpfs/remote"
+	"sftpfs/xattr"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+	"github.com/pkg/sftp"
+)
+
+// errno maps an error from the SFTP layer to the errno reported to the
+// kernel.
+func errno(err error) error {
+	var statusErr *sftp.StatusError
+
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, remote.ErrDisconnected),
+		errors.Is(err, sftp.ErrSSHFxConnectionLost),
+		errors.Is(err, sftp.ErrSSHFxNoConnection):
+		return syscall.ENOTCONN
+	case errors.Is(err, xattr.ErrNoAttr):
+		return fuse.ENOATTR
+	case errors.Is(err, xattr.ErrUnsupported):
+		return fuse.ENOSYS
+	case errors.Is(err, os.ErrNotExist):
+		return fuse.ENOENT
+	case errors.Is(err, os.ErrPermission):
+		return syscall.EACCES
+	case errors.As(err, &statusErr):
+		return statusErrno(statusErr)
+	default:
+		return fuse.EIO
+	}
+}
+
+func statusErrno(err *sftp.StatusError) error {
+	switch err.FxCode() {
+	case sftp.ErrSSHFxNoSuchFile:
+		return fuse.ENOENT
+	case sftp.ErrSSHFxPermissionDenied:
+		return syscall.EACCES
+	case sftp.ErrSSHFxOpUnsupported:
+		return fuse.ENOSYS
+	case sftp.ErrSSHFxNoConnection, sftp.ErrSSHFxConnectionLost:
+		return syscall.ENOTCONN
+	default:
+		return fuse.EIO
+	}
+}
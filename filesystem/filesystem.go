@@ -1,9 +1,18 @@
 package filesystem
 
 import (
+	"errors"
+	"fmt"
+	"log"
 	"os"
+	"path"
+	"path/filepath"
 	"sftpfs/handle"
+	"sftpfs/idmap"
 	"sftpfs/inode"
+	"sftpfs/remote"
+	"sftpfs/xattr"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,23 +21,131 @@ import (
 	"github.com/pkg/sftp"
 )
 
-func New(sftpClient *sftp.Client) fuseutil.FileSystem {
+// Config holds the settings of a mounted file system.
+type Config struct {
+	// RemotePath is the remote directory that becomes the root of the
+	// mount. Relative paths are resolved against the login directory, and an
+	// empty path mounts the login directory itself.
+	RemotePath string
+
+	// IDMap translates the owners of remote files. Nil passes the remote
+	// IDs through unchanged.
+	IDMap idmap.Mapper
+
+	// TransformSymlinks turns absolute link targets that point into the
+	// mounted tree into relative ones, so that they resolve inside the mount.
+	TransformSymlinks bool
+
+	// StatFSFallback is the size in bytes reported as free when the server
+	// doesn't support statvfs@openssh.com. Zero makes StatFS fail instead.
+	StatFSFallback uint64
+
+	// DirCacheTTL is how long directory listings are used before the remote
+	// directory is checked for changes.
+	DirCacheTTL time.Duration
+
+	// AttrTimeout is how long the kernel may cache the attributes of an
+	// inode.
+	AttrTimeout time.Duration
+
+	// EntryTimeout is how long the kernel may cache the inode a name
+	// resolves to.
+	EntryTimeout time.Duration
+
+	// NegativeTimeout is how long names that don't exist are remembered, by
+	// the file system and the kernel. Zero disables negative caching.
+	NegativeTimeout time.Duration
+
+	// PollInterval is how often the server is checked for changes to the
+	// directories in use and the open files. Zero disables polling.
+	PollInterval time.Duration
+
+	// Xattrs stores extended attributes. Nil disables them.
+	Xattrs xattr.Store
+
+	// StrictSync makes fsync(2) fail on servers without fsync@openssh.com.
+	// Otherwise the writes are only flushed to the server.
+	StrictSync bool
+
+	// Notifier tells the kernel about the remote changes found by polling.
+	// Nil leaves the kernel to notice them once its caches expire.
+	Notifier Notifier
+}
+
+// Notifier makes the kernel drop what it cached about inodes and names.
+type Notifier interface {
+	InvalidateInode(id fuseops.InodeID) error
+	InvalidateEntry(parent fuseops.InodeID, name string) error
+}
+
+const (
+	statVFSExtension     = "statvfs@openssh.com"
+	posixRenameExtension = "posix-rename@openssh.com"
+)
+
+// Modes of fallocate(2).
+const (
+	fallocKeepSize  = 0x1
+	fallocPunchHole = 0x2
+)
+
+// Flags of setxattr(2).
+const (
+	xattrCreate  = 0x1
+	xattrReplace = 0x2
+)
+
+// statVFSTTL is how long the file system statistics of the server are
+// reused. df and friends tend to ask several times in a row.
+const statVFSTTL = 5 * time.Second
+
+func New(conn *remote.Conn, cfg Config) (fuseutil.FileSystem, error) {
 	fs := &filesystem{}
 
 	fs.inodes = make(map[fuseops.InodeID]inode.Inode)
+	fs.lookupCounts = make(map[fuseops.InodeID]uint64)
 	fs.nextInodeID = inodeIDGenerator(fuseops.RootInodeID + 10)
 
 	fs.handles = make(map[fuseops.HandleID]handle.Handle)
+	fs.unlinked = make(map[fuseops.InodeID]bool)
+	fs.links = make(map[fuseops.InodeID][]string)
+	fs.written = make(map[fuseops.HandleID]bool)
 	fs.nextHandleID = handleIDGenerator(0)
 
-	fs.uid = 1000
-	fs.gid = 1000
-	fs.sftpClient = sftpClient
+	fs.ids = cfg.IDMap
+	if fs.ids == nil {
+		fs.ids = idmap.None()
+	}
+
+	fs.xattrs = cfg.Xattrs
+	if fs.xattrs == nil {
+		fs.xattrs = xattr.None()
+	}
+
+	fs.dirCacheTTL = cfg.DirCacheTTL
+	fs.conn = conn
+	fs.transformSymlinks = cfg.TransformSymlinks
+	fs.statFSFallback = cfg.StatFSFallback
+	fs.strictSync = cfg.StrictSync
+	fs.notifier = cfg.Notifier
 	fs.Mutex = &sync.Mutex{}
 
-	fs.createRoot()
+	fs.hot = make(map[fuseops.InodeID]time.Time)
+	fs.missing = make(map[missingName]time.Time)
+	fs.attrTimeout = cfg.AttrTimeout
+	fs.entryTimeout = cfg.EntryTimeout
+	fs.negativeTimeout = cfg.NegativeTimeout
+	fs.done = make(chan struct{})
 
-	return fs
+	if err := fs.createRoot(cfg.RemotePath); err != nil {
+		return nil, err
+	}
+
+	if cfg.PollInterval > 0 {
+		go fs.poll(cfg.PollInterval)
+	}
+
+	return fs, nil
 }
 
 func inodeIDGenerator(first fuseops.InodeID) func() fuseops.InodeID {
@@ -51,37 +168,441 @@ type filesystem struct {
 	inodes       map[fuseops.InodeID]inode.Inode
 	nextHandleID func() fuseops.HandleID
 
+	// lookupCounts holds the number of references the kernel has to each
+	// inode. An inode is dropped from inodes once its count reaches zero.
+	lookupCounts map[fuseops.InodeID]uint64
+
 	handles     map[fuseops.HandleID]handle.Handle
 	nextInodeID func() fuseops.InodeID
 
-	uid uint32
-	gid uint32
+	// unlinked holds the inodes that were unlinked while open. Their remote
+	// files live on under a hidden name until the last handle is released.
+	unlinked map[fuseops.InodeID]bool
+
+	// written holds the file handles that were written to since they were
+	// last flushed. The server sees those writes before the cached
+	// attributes do, so the poller leaves their inodes alone.
+	written map[fuseops.HandleID]bool
 
-	sftpClient *sftp.Client
+	// links holds the remote paths of the inodes that have several names.
+	// SFTP reports neither link counts nor inode numbers, so only the links
+	// created through the mount are known.
+	links map[fuseops.InodeID][]string
+
+	ids    idmap.Mapper
+	xattrs xattr.Store
+
+	dirCacheTTL       time.Duration
+	transformSymlinks bool
+	strictSync        bool
+
+	statFSFallback uint64
+	statVFSCache   *sftp.StatVFS
+	statVFSTime    time.Time
+
+	attrTimeout  time.Duration
+	entryTimeout time.Duration
+
+	// missing holds when the negative lookups of names expire.
+	missing         map[missingName]time.Time
+	negativeTimeout time.Duration
+
+	// hot holds when each directory was last used, for the poller.
+	hot      map[fuseops.InodeID]time.Time
+	notifier Notifier
+	done     chan struct{}
+
+	conn *remote.Conn
 
 	*sync.Mutex
 }
 
-func (fs *filesystem) createRoot() {
-	attrs := fuseops.InodeAttributes{
-		Size:  4096,
-		Nlink: 2,
-		Uid:   fs.uid,
-		Gid:   fs.gid,
-		Mode:  0777 | os.ModeDir,
+func (fs *filesystem) createRoot(remotePath string) error {
+	client, err := fs.conn.Client()
+	if err != nil {
+		return err
+	}
+
+	if !path.IsAbs(remotePath) {
+		wd, err := client.Getwd()
+		if err != nil {
+			return fmt.Errorf("failed to get remote working directory: %v", err)
+		}
 
-		Atime:  time.Now(),
-		Ctime:  time.Now(),
-		Mtime:  time.Now(),
-		Crtime: time.Now(),
+		remotePath = path.Join(wd, remotePath)
 	}
 
-	remotePath, err := fs.sftpClient.Getwd()
+	info, err := client.Stat(remotePath)
 	if err != nil {
-		panic(err) // TODO
+		return fmt.Errorf("failed to stat remote root '%s': %v", remotePath, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("remote root '%s' is not a directory", remotePath)
 	}
 
-	rootDir := inode.NewDir(fuseops.RootInodeID, &attrs, remotePath, fs.sftpClient)
+	attrs := inode.Attributes(info, fs.ids)
+	rootDir := inode.NewDir(fuseops.RootInodeID, &attrs, remotePath, fs.conn, fs.ids, fs.dirCacheTTL)
 
 	fs.inodes[fuseops.RootInodeID] = rootDir
+
+	return nil
+}
+
+// statVFS returns the statistics of the file system holding the remote
+// root, asking the server at most once per statVFSTTL.
+func (fs *filesystem) statVFS(client *sftp.Client) (*sftp.StatVFS, error) {
+	if fs.statVFSCache != nil && time.Since(fs.statVFSTime) < statVFSTTL {
+		return fs.statVFSCache, nil
+	}
+
+	stat, err := client.StatVFS(fs.inodes[fuseops.RootInodeID].RemotePath())
+	if err != nil {
+		return nil, err
+	}
+
+	fs.statVFSCache = stat
+	fs.statVFSTime = time.Now()
+
+	return stat, nil
+}
+
+// refreshAttributes replaces the cached attributes of in with a fresh stat
+// of the remote file.
+func (fs *filesystem) refreshAttributes(client *sftp.Client, in inode.Inode) error {
+	info, err := client.Lstat(in.RemotePath())
+	if err != nil {
+		return err
+	}
+
+	inode.UpdateAttributes(in, info, fs.ids)
+
+	return nil
+}
+
+// freshAttributes asks the server for the attributes of in again once the
+// cached ones are older than the attribute timeout. Directory listings are
+// reused for longer than that, and don't tell when a file was written to.
+// Inodes without links are left alone, as their remote path may belong to
+// another file by now.
+func (fs *filesystem) freshAttributes(in inode.Inode) error {
+	if time.Since(in.AttributesTime()) < fs.attrTimeout || in.GetAttributes().Nlink == 0 {
+		return nil
+	}
+
+	client, err := fs.conn.Client()
+	if err != nil {
+		return err
+	}
+
+	// Buffered writes would otherwise be missing from the size.
+	if err := fs.flushFileHandles(in.InodeID()); err != nil {
+		return err
+	}
+
+	return fs.refreshAttributes(client, in)
+}
+
+// missingName is a name that was looked up in a directory and not found.
+type missingName struct {
+	parent fuseops.InodeID
+	name   string
+}
+
+// maxMissing is the number of negative entries kept before the expired
+// ones are swept out.
+const maxMissing = 4096
+
+// cachedMissing reports whether name is known not to exist in parent, and
+// until when.
+func (fs *filesystem) cachedMissing(parent fuseops.InodeID, name string) (time.Time, bool) {
+	key := missingName{parent, name}
+
+	expiration, ok := fs.missing[key]
+	if !ok {
+		return time.Time{}, false
+	}
+	if time.Now().After(expiration) {
+		delete(fs.missing, key)
+		return time.Time{}, false
+	}
+
+	return expiration, true
+}
+
+// addMissing remembers that name doesn't exist in parent and returns when
+// that knowledge expires.
+func (fs *filesystem) addMissing(parent fuseops.InodeID, name string) time.Time {
+	now := time.Now()
+
+	if len(fs.missing) >= maxMissing {
+		for key, expiration := range fs.missing {
+			if now.After(expiration) {
+				delete(fs.missing, key)
+			}
+		}
+	}
+
+	expiration := now.Add(fs.negativeTimeout)
+	fs.missing[missingName{parent, name}] = expiration
+
+	return expiration
+}
+
+// clearMissing forgets a negative entry once name was created in parent.
+func (fs *filesystem) clearMissing(parent fuseops.InodeID, name string) {
+	delete(fs.missing, missingName{parent, name})
+}
+
+// clearMissingIn forgets the negative entries of the directory.
+func (fs *filesystem) clearMissingIn(parent fuseops.InodeID) {
+	for key := range fs.missing {
+		if key.parent == parent {
+			delete(fs.missing, key)
+		}
+	}
+}
+
+// lookedUp records a reference handed out to the kernel, which happens for
+// every reply that carries a ChildInodeEntry. An inode ID is assigned first
+// if in doesn't have one yet.
+func (fs *filesystem) lookedUp(in inode.Inode) {
+	if in.InodeID() < fuseops.RootInodeID {
+		in.SetInodeID(fs.nextInodeID())
+	}
+
+	fs.inodes[in.InodeID()] = in
+	fs.lookupCounts[in.InodeID()]++
+}
+
+// childEntry describes in to the kernel, with the configured timeouts.
+func (fs *filesystem) childEntry(in inode.Inode) fuseops.ChildInodeEntry {
+	now := time.Now()
+
+	return fuseops.ChildInodeEntry{
+		Child:                in.InodeID(),
+		Attributes:           *in.GetAttributes(),
+		AttributesExpiration: now.Add(fs.attrTimeout),
+		EntryExpiration:      now.Add(fs.entryTimeout),
+	}
+}
+
+// forget drops n references to the inode. Once the kernel holds none, the
+// inode is removed from the inode table; it keeps its ID, so the next lookup
+// of the same entry hands it out again. The remote file is not touched.
+//
+// The kernel can't hold anything below a directory it forgot, so the entries
+// of the directory are dropped as well. Otherwise every inode ever visited
+// would stay reachable from the root.
+func (fs *filesystem) forget(id fuseops.InodeID, n uint64) {
+	if id == fuseops.RootInodeID {
+		return
+	}
+
+	count := fs.lookupCounts[id]
+	if n < count {
+		fs.lookupCounts[id] = count - n
+		return
+	}
+
+	if dir, ok := fs.inodes[id].(inode.DirInode); ok {
+		dir.Clear()
+		delete(fs.hot, id)
+		fs.clearMissingIn(id)
+	}
+
+	delete(fs.lookupCounts, id)
+	delete(fs.links, id)
+	delete(fs.inodes, id)
+}
+
+// addLink records remotePath as another name of in.
+func (fs *filesystem) addLink(in inode.Inode, remotePath string) {
+	id := in.InodeID()
+	if len(fs.links[id]) == 0 {
+		fs.links[id] = []string{in.RemotePath()}
+	}
+
+	fs.links[id] = append(fs.links[id], remotePath)
+}
+
+// removeLink forgets the name remotePath of in. If it was the path in is
+// accessed through, one of the remaining names takes its place.
+func (fs *filesystem) removeLink(in inode.Inode, remotePath string) {
+	id := in.InodeID()
+
+	var remaining []string
+	for _, p := range fs.links[id] {
+		if p != remotePath {
+			remaining = append(remaining, p)
+		}
+	}
+
+	if in.RemotePath() == remotePath && len(remaining) > 0 {
+		in.SetRemotePath(remaining[0])
+	}
+
+	if len(remaining) > 1 {
+		fs.links[id] = remaining
+	} else {
+		delete(fs.links, id)
+	}
+}
+
+// renamed updates in after its name oldPath was moved to newPath.
+func (fs *filesystem) renamed(in inode.Inode, oldPath, newPath string) {
+	if _, ok := fs.links[in.InodeID()]; ok {
+		fs.removeLink(in, oldPath)
+		fs.addLink(in, newPath)
+		return
+	}
+
+	in.SetRemotePath(newPath)
+}
+
+// replaced drops the name remotePath of in, which a rename moved another file
+// onto. Unless other names keep it alive, the inode is left without links;
+// the kernel may still hold it, so it stays in the inode table until it is
+// forgotten.
+func (fs *filesystem) replaced(in inode.Inode, remotePath string) {
+	attrs := in.GetAttributes()
+	if attrs.Nlink > 1 {
+		attrs.Nlink--
+		fs.removeLink(in, remotePath)
+		return
+	}
+
+	attrs.Nlink = 0
+
+	// The remote path belongs to the moved file now. A hidden file went out
+	// of the way before, anything else is pointed at a name that doesn't
+	// exist, so that changes through the inode fail instead of hitting the
+	// new file.
+	if !fs.unlinked[in.InodeID()] {
+		in.SetRemotePath(hiddenPath(in, remotePath, "replaced"))
+	}
+}
+
+// hide moves the remote file of in, which is about to lose its last name
+// remotePath while handles are open for it, out of sight. The file is deleted
+// once the last handle is released.
+func (fs *filesystem) hide(client *sftp.Client, in inode.Inode, remotePath string) error {
+	hidden := hiddenPath(in, remotePath, "unlinked")
+	if err := client.Rename(remotePath, hidden); err != nil {
+		return err
+	}
+
+	in.SetRemotePath(hidden)
+	fs.unlinked[in.InodeID()] = true
+
+	return nil
+}
+
+// unhide moves the remote file of in back to remotePath after hide, for when
+// the name wasn't lost after all.
+func (fs *filesystem) unhide(client *sftp.Client, in inode.Inode, remotePath string) {
+	if err := client.Rename(in.RemotePath(), remotePath); err != nil {
+		log.Printf("failed to move hidden file '%s' back to '%s': %v", in.RemotePath(), remotePath, err)
+		return
+	}
+
+	in.SetRemotePath(remotePath)
+	delete(fs.unlinked, in.InodeID())
+}
+
+// hiddenPath returns a hidden name for in next to remotePath, unique to the
+// inode and this process.
+func hiddenPath(in inode.Inode, remotePath, kind string) string {
+	return path.Join(
+		path.Dir(remotePath),
+		fmt.Sprintf("%s%s-%d-%d", inode.HiddenPrefix, kind, os.Getpid(), in.InodeID()),
+	)
+}
+
+// xattrKey returns the key of the extended attributes of in.
+func xattrKey(in inode.Inode) xattr.Key {
+	if _, ok := in.(inode.DirInode); ok {
+		return xattr.DirKey(in.RemotePath())
+	}
+
+	return xattr.FileKey(in.RemotePath())
+}
+
+// takeXattrs deletes the extended attributes stored under key and returns
+// them for restoreXattrs.
+func (fs *filesystem) takeXattrs(key xattr.Key) map[string][]byte {
+	names, err := fs.xattrs.List(key)
+	if err != nil && !errors.Is(err, xattr.ErrUnsupported) {
+		log.Printf("failed to list extended attributes of '%s': %v", key.Dir, err)
+	}
+
+	values := make(map[string][]byte, len(names))
+	for _, name := range names {
+		if value, err := fs.xattrs.Get(key, name); err == nil {
+			values[name] = value
+		}
+	}
+
+	if err := fs.xattrs.Delete(key); err != nil {
+		log.Printf("failed to delete extended attributes of '%s': %v", key.Dir, err)
+	}
+
+	return values
+}
+
+// restoreXattrs puts back the attributes taken by takeXattrs.
+func (fs *filesystem) restoreXattrs(key xattr.Key, values map[string][]byte) {
+	for name, value := range values {
+		if err := fs.xattrs.Set(key, name, value); err != nil {
+			log.Printf("failed to restore extended attribute '%s' of '%s': %v", name, key.Dir, err)
+		}
+	}
+}
+
+// openFileHandles returns the number of open file handles for the inode.
+func (fs *filesystem) openFileHandles(id fuseops.InodeID) int {
+	n := 0
+	for _, h := range fs.handles {
+		if _, ok := h.(handle.FileHandle); ok && h.Inode().InodeID() == id {
+			n++
+		}
+	}
+
+	return n
+}
+
+// flushFileHandles sends the buffered writes of every handle open for the
+// inode, so that the server has the current contents. Earlier write errors
+// are left for FlushFile to report when the handle is closed.
+func (fs *filesystem) flushFileHandles(id fuseops.InodeID) error {
+	for _, h := range fs.handles {
+		if fh, ok := h.(handle.FileHandle); ok && h.Inode().InodeID() == id {
+			if err := fh.FlushBuffer(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// symlinkTarget returns the target reported to the kernel for a link stored
+// at linkPath. With TransformSymlinks, absolute targets below the remote root
+// become relative to the link, since the remote root is not where the mount
+// lives locally.
+func (fs *filesystem) symlinkTarget(linkPath, target string) string {
+	if !fs.transformSymlinks || !path.IsAbs(target) {
+		return target
+	}
+
+	root := fs.inodes[fuseops.RootInodeID].RemotePath()
+	if target != root && !strings.HasPrefix(target, strings.TrimSuffix(root, "/")+"/") {
+		return target
+	}
+
+	rel, err := filepath.Rel(path.Dir(linkPath), target)
+	if err != nil {
+		return target
+	}
+
+	return filepath.ToSlash(rel)
 }
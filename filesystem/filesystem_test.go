@@ -0,0 +1,554 @@
+package filesystem
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sftpfs/remote"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// serveSFTP runs an SFTP server for the local file system on an incoming
+// SSH connection.
+func serveSFTP(t *testing.T, conn net.Conn, signer ssh.Signer) {
+	cfg := &ssh.ServerConfig{NoClientAuth: true}
+	cfg.AddHostKey(signer)
+
+	_, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+	if err != nil {
+		t.Logf("ssh handshake failed: %v", err)
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChan := range chans {
+		ch, chReqs, err := newChan.Accept()
+		if err != nil {
+			continue
+		}
+
+		go func() {
+			for req := range chReqs {
+				ok := req.Type == "subsystem"
+				req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+
+				srv, err := sftp.NewServer(ch)
+				if err == nil {
+					srv.Serve()
+				}
+				ch.Close()
+			}
+		}()
+	}
+}
+
+// newTestFS mounts nothing, but returns a file system for the local
+// directory root, served over SFTP.
+func newTestFS(t *testing.T, root string, cfg Config) *filesystem {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTP(t, conn, signer)
+		}
+	}()
+
+	dial := func(interactive bool) (*ssh.Client, error) {
+		return ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+			User:            "test",
+			HostKeyCallback: ssh.FixedHostKey(signer.PublicKey()),
+		})
+	}
+
+	conn, err := remote.New(dial, remote.Options{ReconnectGrace: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	cfg.RemotePath = root
+	server, err := New(conn, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return server.(*filesystem)
+}
+
+func quietLog(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+}
+
+func lookUp(t *testing.T, fs *filesystem, parent fuseops.InodeID, name string) fuseops.InodeID {
+	return lookUpEntry(t, fs, parent, name).Child
+}
+
+func lookUpEntry(t *testing.T, fs *filesystem, parent fuseops.InodeID, name string) fuseops.ChildInodeEntry {
+	op := &fuseops.LookUpInodeOp{Parent: parent, Name: name}
+	if err := fs.LookUpInode(context.Background(), op); err != nil {
+		t.Fatalf("failed to look up '%s': %v", name, err)
+	}
+
+	return op.Entry
+}
+
+func TestBatchForget(t *testing.T) {
+	quietLog(t)
+
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "d/x"} {
+		if err := os.WriteFile(filepath.Join(root, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs := newTestFS(t, root, Config{DirCacheTTL: time.Minute})
+
+	a := lookUp(t, fs, fuseops.RootInodeID, "a")
+	if again := lookUp(t, fs, fuseops.RootInodeID, "a"); again != a {
+		t.Fatalf("second lookup of 'a' returned inode %v, want %v", again, a)
+	}
+	d := lookUp(t, fs, fuseops.RootInodeID, "d")
+	x := lookUp(t, fs, d, "x")
+
+	forget := func(entries ...fuseops.BatchForgetEntry) {
+		op := &fuseops.BatchForgetOp{Entries: entries}
+		if err := fs.BatchForget(context.Background(), op); err != nil {
+			t.Fatalf("BatchForget failed: %v", err)
+		}
+	}
+
+	forget(
+		fuseops.BatchForgetEntry{Inode: a, N: 1},
+		fuseops.BatchForgetEntry{Inode: x, N: 1},
+		fuseops.BatchForgetEntry{Inode: fuseops.RootInodeID, N: 1},
+	)
+
+	if fs.lookupCounts[a] != 1 {
+		t.Errorf("lookup count of 'a' is %v, want 1", fs.lookupCounts[a])
+	}
+	if _, ok := fs.inodes[x]; ok {
+		t.Errorf("forgotten inode of 'd/x' is still in the inode table")
+	}
+	if _, ok := fs.inodes[fuseops.RootInodeID]; !ok {
+		t.Errorf("root inode was forgotten")
+	}
+
+	forget(
+		fuseops.BatchForgetEntry{Inode: a, N: 1},
+		fuseops.BatchForgetEntry{Inode: d, N: 1},
+	)
+
+	if len(fs.inodes) != 1 || len(fs.lookupCounts) != 0 {
+		t.Errorf("inode table holds %v inodes and %v lookup counts after forgetting everything, want 1 and 0",
+			len(fs.inodes), len(fs.lookupCounts))
+	}
+
+	// Entries of the directory that stay cached keep their inode IDs, while
+	// those of a forgotten directory are dropped.
+	if again := lookUp(t, fs, fuseops.RootInodeID, "a"); again != a {
+		t.Errorf("lookup of 'a' after forget returned inode %v, want %v", again, a)
+	}
+	if again := lookUp(t, fs, fuseops.RootInodeID, "d"); again != d {
+		t.Errorf("lookup of 'd' after forget returned inode %v, want %v", again, d)
+	}
+	if again := lookUp(t, fs, d, "x"); again == x {
+		t.Errorf("entries of the forgotten directory 'd' were kept")
+	}
+}
+
+func TestForgetDropsLinks(t *testing.T) {
+	quietLog(t)
+
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := newTestFS(t, root, Config{DirCacheTTL: time.Minute})
+	ctx := context.Background()
+
+	a := lookUp(t, fs, fuseops.RootInodeID, "a")
+
+	op := &fuseops.CreateLinkOp{Parent: fuseops.RootInodeID, Name: "b", Target: a}
+	if err := fs.CreateLink(ctx, op); err != nil {
+		t.Fatalf("CreateLink failed: %v", err)
+	}
+	if len(fs.links[a]) != 2 {
+		t.Fatalf("inode has %v known names after CreateLink, want 2", len(fs.links[a]))
+	}
+
+	if err := fs.ForgetInode(ctx, &fuseops.ForgetInodeOp{Inode: a, N: 2}); err != nil {
+		t.Fatalf("ForgetInode failed: %v", err)
+	}
+
+	if _, ok := fs.links[a]; ok {
+		t.Errorf("names of the forgotten inode are still known")
+	}
+}
+
+// TestAttributesFollowWrites checks that the size of a file is picked up
+// after writes through the file system and on the server, neither of which
+// changes the modification time of the directory.
+func TestAttributesFollowWrites(t *testing.T) {
+	quietLog(t)
+
+	root := t.TempDir()
+	file := filepath.Join(root, "f")
+	if err := os.WriteFile(file, []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	const attrTimeout = 500 * time.Millisecond
+	fs := newTestFS(t, root, Config{DirCacheTTL: time.Minute, AttrTimeout: attrTimeout})
+	ctx := context.Background()
+
+	f := lookUp(t, fs, fuseops.RootInodeID, "f")
+
+	open := &fuseops.OpenFileOp{Inode: f, OpenFlags: syscall.O_RDWR}
+	if err := fs.OpenFile(ctx, open); err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	write := &fuseops.WriteFileOp{Inode: f, Handle: open.Handle, Offset: 3, Data: []byte("defghij")}
+	if err := fs.WriteFile(ctx, write); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := fs.FlushFile(ctx, &fuseops.FlushFileOp{Inode: f, Handle: open.Handle}); err != nil {
+		t.Fatalf("FlushFile failed: %v", err)
+	}
+	if err := fs.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{Handle: open.Handle}); err != nil {
+		t.Fatalf("ReleaseFileHandle failed: %v", err)
+	}
+	if err := fs.ForgetInode(ctx, &fuseops.ForgetInodeOp{Inode: f, N: 1}); err != nil {
+		t.Fatalf("ForgetInode failed: %v", err)
+	}
+
+	if size := lookUpEntry(t, fs, fuseops.RootInodeID, "f").Attributes.Size; size != 10 {
+		t.Errorf("size after writing through the file system is %v, want 10", size)
+	}
+
+	remote, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote.Write([]byte("klm"))
+	remote.Close()
+
+	time.Sleep(attrTimeout)
+
+	if size := lookUpEntry(t, fs, fuseops.RootInodeID, "f").Attributes.Size; size != 13 {
+		t.Errorf("size after appending on the server is %v, want 13", size)
+	}
+}
+
+func TestGetAttributesAfterTimeout(t *testing.T) {
+	quietLog(t)
+
+	root := t.TempDir()
+	file := filepath.Join(root, "f")
+	if err := os.WriteFile(file, []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	const attrTimeout = 500 * time.Millisecond
+	fs := newTestFS(t, root, Config{DirCacheTTL: time.Minute, AttrTimeout: attrTimeout})
+
+	f := lookUp(t, fs, fuseops.RootInodeID, "f")
+
+	if err := os.WriteFile(file, []byte("abcdef"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(file, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	getAttributes := func() fuseops.InodeAttributes {
+		op := &fuseops.GetInodeAttributesOp{Inode: f}
+		if err := fs.GetInodeAttributes(context.Background(), op); err != nil {
+			t.Fatalf("GetInodeAttributes failed: %v", err)
+		}
+		return op.Attributes
+	}
+
+	if attrs := getAttributes(); attrs.Size != 3 {
+		t.Errorf("size within the attribute timeout is %v, want the cached 3", attrs.Size)
+	}
+
+	time.Sleep(attrTimeout)
+
+	if attrs := getAttributes(); attrs.Size != 6 || attrs.Mode.Perm() != 0600 {
+		t.Errorf("attributes after the timeout are size %v and mode %v, want 6 and 0600",
+			attrs.Size, attrs.Mode.Perm())
+	}
+}
+
+// TestRenameOverFile checks that the inode of a file replaced by a rename no
+// longer reaches the remote file that took its name.
+func TestRenameOverFile(t *testing.T) {
+	quietLog(t)
+
+	root := t.TempDir()
+	for _, name := range []string{"a", "b", "c"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(name+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs := newTestFS(t, root, Config{DirCacheTTL: time.Minute})
+	ctx := context.Background()
+
+	rename := func(from, to string) {
+		op := &fuseops.RenameOp{
+			OldParent: fuseops.RootInodeID,
+			OldName:   from,
+			NewParent: fuseops.RootInodeID,
+			NewName:   to,
+		}
+		if err := fs.Rename(ctx, op); err != nil {
+			t.Fatalf("Rename failed: %v", err)
+		}
+	}
+	truncate := func(in fuseops.InodeID, h *fuseops.HandleID) error {
+		size := uint64(0)
+		return fs.SetInodeAttributes(ctx, &fuseops.SetInodeAttributesOp{Inode: in, Handle: h, Size: &size})
+	}
+	content := func(name string) string {
+		b, err := os.ReadFile(filepath.Join(root, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	// Without open handles the old inode is left with nothing to change.
+	b := lookUp(t, fs, fuseops.RootInodeID, "b")
+	rename("a", "b")
+	if err := truncate(b, nil); err == nil {
+		t.Errorf("truncating the replaced inode succeeded")
+	}
+	if got := content("b"); got != "aa" {
+		t.Errorf("content of 'b' is %q, want \"aa\"", got)
+	}
+
+	// With an open handle the old file lives on until it is released.
+	c := lookUp(t, fs, fuseops.RootInodeID, "c")
+	open := &fuseops.OpenFileOp{Inode: c, OpenFlags: syscall.O_RDWR}
+	if err := fs.OpenFile(ctx, open); err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	rename("b", "c")
+	if err := truncate(c, nil); err != nil {
+		t.Errorf("truncating the replaced inode with an open handle failed: %v", err)
+	}
+	if got := content("c"); got != "aa" {
+		t.Errorf("content of 'c' is %q, want \"aa\"", got)
+	}
+	if err := fs.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{Handle: open.Handle}); err != nil {
+		t.Fatalf("ReleaseFileHandle failed: %v", err)
+	}
+
+	names, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 {
+		t.Errorf("%v files left on the server, want only 'c'", len(names))
+	}
+}
+
+// countingNotifier counts the invalidations sent to the kernel.
+type countingNotifier struct {
+	inodes, entries int
+}
+
+func (n *countingNotifier) InvalidateInode(fuseops.InodeID) error {
+	n.inodes++
+	return nil
+}
+
+func (n *countingNotifier) InvalidateEntry(fuseops.InodeID, string) error {
+	n.entries++
+	return nil
+}
+
+// TestPollIgnoresOwnWrites checks that writes through the mount don't make
+// the poller invalidate the file, while changes on the server still do.
+func TestPollIgnoresOwnWrites(t *testing.T) {
+	quietLog(t)
+
+	root := t.TempDir()
+	file := filepath.Join(root, "f")
+	if err := os.WriteFile(file, []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	notifier := &countingNotifier{}
+	fs := newTestFS(t, root, Config{DirCacheTTL: time.Minute, Notifier: notifier})
+	ctx := context.Background()
+
+	f := lookUp(t, fs, fuseops.RootInodeID, "f")
+
+	open := &fuseops.OpenFileOp{Inode: f, OpenFlags: syscall.O_RDWR}
+	if err := fs.OpenFile(ctx, open); err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+
+	write := func(offset int64) {
+		op := &fuseops.WriteFileOp{Inode: f, Handle: open.Handle, Offset: offset, Data: []byte("x")}
+		if err := fs.WriteFile(ctx, op); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		// The second write isn't sequential, which sends the first one to
+		// the server before the flush.
+		write(int64(3 + i))
+		write(0)
+		fs.checkRemoteChanges()
+
+		if err := fs.FlushFile(ctx, &fuseops.FlushFileOp{Inode: f, Handle: open.Handle}); err != nil {
+			t.Fatalf("FlushFile failed: %v", err)
+		}
+		fs.checkRemoteChanges()
+	}
+
+	if notifier.inodes != 0 {
+		t.Errorf("writes through the mount caused %v inode invalidations, want 0", notifier.inodes)
+	}
+
+	if err := os.WriteFile(file, []byte("changed on the server"), 0); err != nil {
+		t.Fatal(err)
+	}
+	fs.checkRemoteChanges()
+
+	if notifier.inodes != 1 {
+		t.Errorf("a change on the server caused %v inode invalidations, want 1", notifier.inodes)
+	}
+}
+
+// TestForgetShrinksInodeTable walks a large tree through a real mount and
+// checks that the inodes are released once the kernel drops its caches.
+func TestForgetShrinksInodeTable(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the mount test in short mode")
+	}
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		t.Skip("/dev/fuse is not available")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("dropping the kernel caches requires root")
+	}
+	quietLog(t)
+
+	const dirs, filesPerDir = 100, 1000
+
+	root := t.TempDir()
+	for i := 0; i < dirs; i++ {
+		dir := filepath.Join(root, fmt.Sprintf("d%03d", i))
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < filesPerDir; j++ {
+			f, err := os.Create(filepath.Join(dir, fmt.Sprintf("f%04d", j)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+		}
+	}
+
+	fs := newTestFS(t, root, Config{
+		DirCacheTTL:  time.Minute,
+		AttrTimeout:  time.Minute,
+		EntryTimeout: time.Minute,
+	})
+
+	mountpoint := t.TempDir()
+	mfs, err := fuse.Mount(mountpoint, fuseutil.NewFileSystemServer(fs), &fuse.MountConfig{FSName: "sftpfs-test"})
+	if err != nil {
+		t.Skipf("failed to mount: %v", err)
+	}
+	defer func() {
+		if err := syscall.Unmount(mountpoint, 0); err != nil {
+			t.Errorf("failed to unmount: %v", err)
+			return
+		}
+		mfs.Join(context.Background())
+	}()
+
+	walked := 0
+	err = filepath.Walk(mountpoint, func(string, os.FileInfo, error) error {
+		walked++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 1 + dirs + dirs*filesPerDir; walked != want {
+		t.Fatalf("walked %v entries, want %v", walked, want)
+	}
+
+	inodes := func() int {
+		fs.Lock()
+		defer fs.Unlock()
+		return len(fs.inodes)
+	}
+
+	before := inodes()
+	if before < dirs*filesPerDir {
+		t.Fatalf("inode table holds %v inodes after the walk, want at least %v", before, dirs*filesPerDir)
+	}
+
+	// Forgets arrive asynchronously, and a directory is only released once
+	// its children are.
+	deadline := time.Now().Add(30 * time.Second)
+	for inodes() > before/100 && time.Now().Before(deadline) {
+		if err := os.WriteFile("/proc/sys/vm/drop_caches", []byte("2"), 0); err != nil {
+			t.Skipf("failed to drop caches: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if after := inodes(); after > before/100 {
+		t.Errorf("inode table holds %v of %v inodes after dropping caches", after, before)
+	}
+}
@@ -2,15 +2,19 @@ package filesystem
 
 import (
 	"context"
+	"errors"
 	"log"
 	"os"
 	"path"
 	"sftpfs/handle"
 	"sftpfs/inode"
+	"sftpfs/xattr"
+	"syscall"
 	"time"
 
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
+	"github.com/pkg/sftp"
 )
 
 // fuseutil.FileSystem implementation
@@ -24,21 +28,50 @@ func (fs *filesystem) StatFS(
 
 	log.Printf("StatFS")
 
-	// Simulate a large amount of free space so that the Finder doesn't refuse to
-	// copy in files. (See issue #125.) Use 2^17 as the block size because that
-	// is the largest that OS X will pass on.
-	op.BlockSize = 1 << 17
-	op.Blocks = 1 << 33
-	op.BlocksFree = op.Blocks
-	op.BlocksAvailable = op.Blocks
+	client, err := fs.conn.Client()
+	if err != nil {
+		return errno(err)
+	}
+
+	if _, ok := client.HasExtension(statVFSExtension); !ok {
+		if fs.statFSFallback == 0 {
+			return fuse.ENOSYS
+		}
+
+		// Simulate free space so that programs don't refuse to copy in
+		// files. Use 2^17 as the block size because that is the largest
+		// that OS X will pass on.
+		op.BlockSize = 1 << 17
+		op.Blocks = fs.statFSFallback / uint64(op.BlockSize)
+		op.BlocksFree = op.Blocks
+		op.BlocksAvailable = op.Blocks
+
+		op.Inodes = 1 << 50
+		op.InodesFree = op.Inodes
+
+		op.IoSize = 1 << 20
+
+		return nil
+	}
+
+	stat, err := fs.statVFS(client)
+	if err != nil {
+		log.Printf("statvfs failed: %v", err)
+		return errno(err)
+	}
+
+	op.BlockSize = uint32(stat.Frsize)
+	if op.BlockSize == 0 {
+		op.BlockSize = uint32(stat.Bsize)
+	}
+	op.Blocks = stat.Blocks
+	op.BlocksFree = stat.Bfree
+	op.BlocksAvailable = stat.Bavail
 
-	// Similarly with inodes.
-	op.Inodes = 1 << 50
-	op.InodesFree = op.Inodes
+	op.Inodes = stat.Files
+	op.InodesFree = stat.Ffree
 
-	// Prefer large transfers. This is the largest value that OS X will
-	// faithfully pass on, according to fuseops/ops.go.
-	op.IoSize = 1 << 20
+	op.IoSize = uint32(stat.Bsize)
 
 	return nil
 }
@@ -58,21 +91,41 @@ func (fs *filesystem) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp
 		return fuse.EINVAL
 	}
 
-	child := parent.LookUpChild(ctx, op.Name)
-	if child == nil {
-		return fuse.ENOENT
+	fs.touch(op.Parent)
+
+	// A zero Child tells the kernel that the name doesn't exist, and lets
+	// it remember that until EntryExpiration.
+	if expiration, ok := fs.cachedMissing(op.Parent, op.Name); ok {
+		op.Entry = fuseops.ChildInodeEntry{EntryExpiration: expiration}
+		return nil
+	}
+
+	child, err := parent.LookUpChild(ctx, op.Name)
+	if err != nil {
+		log.Printf("failed to look up '%s': %v", op.Name, err)
+		return errno(err)
 	}
+	if child == nil {
+		if fs.negativeTimeout == 0 {
+			return fuse.ENOENT
+		}
 
-	if child.InodeID() < fuseops.RootInodeID {
-		child.SetInodeID(fs.nextInodeID())
-		fs.inodes[child.InodeID()] = child
+		op.Entry = fuseops.ChildInodeEntry{EntryExpiration: fs.addMissing(op.Parent, op.Name)}
+		return nil
 	}
 
-	op.Entry = fuseops.ChildInodeEntry{
-		Child:      child.InodeID(),
-		Attributes: *child.GetAttributes(),
+	if err := fs.freshAttributes(child); err != nil {
+		log.Printf("failed to stat remote file '%s': %v", child.RemotePath(), err)
+		if errors.Is(err, os.ErrNotExist) {
+			parent.Invalidate()
+		}
+		return errno(err)
 	}
 
+	fs.lookedUp(child)
+
+	op.Entry = fs.childEntry(child)
+
 	return nil
 }
 
@@ -86,8 +139,13 @@ func (fs *filesystem) GetInodeAttributes(ctx context.Context, op *fuseops.GetIno
 		return fuse.ENOENT
 	}
 
+	if err := fs.freshAttributes(in); err != nil {
+		log.Printf("failed to stat remote file '%s': %v", in.RemotePath(), err)
+		return errno(err)
+	}
+
 	op.Attributes = *in.GetAttributes()
-	op.AttributesExpiration = time.Now().Add(time.Minute * 3)
+	op.AttributesExpiration = time.Now().Add(fs.attrTimeout)
 
 	return nil
 }
@@ -103,33 +161,81 @@ func (fs *filesystem) SetInodeAttributes(ctx context.Context, op *fuseops.SetIno
 		return fuse.ENOENT
 	}
 
+	// SFTP sets times by path, which follows links, so the times of a link
+	// itself can't be changed.
+	if _, ok := in.(inode.SymlinkInode); ok && (op.Atime != nil || op.Mtime != nil) {
+		return fuse.ENOSYS
+	}
+
+	// ftruncate(2) and friends come with a handle, which lets the change go
+	// through fsetstat on the open remote file.
+	var fhandle handle.FileHandle
+	if op.Handle != nil {
+		if h, ok := fs.handles[*op.Handle]; ok {
+			fhandle, _ = h.(handle.FileHandle)
+		}
+	}
+
+	client, err := fs.conn.Client()
+	if err != nil {
+		return errno(err)
+	}
+
+	// Buffered writes would otherwise land after the change and undo it.
+	if err := fs.flushFileHandles(op.Inode); err != nil {
+		log.Printf("failed to flush remote file '%s': %v", in.RemotePath(), err)
+		return errno(err)
+	}
+
+	remotePath := in.RemotePath()
 	attrs := in.GetAttributes()
 
 	if op.Size != nil {
-		f, err := fs.sftpClient.OpenFile(in.RemotePath(), os.O_RDWR)
-		if err != nil {
-			log.Printf("Failed to open remote file: %v", err)
-			return fuse.EIO
+		if fhandle != nil {
+			err = fhandle.Truncate(int64(*op.Size))
+		} else {
+			err = client.Truncate(remotePath, int64(*op.Size))
 		}
-		if err := f.Truncate(int64(*op.Size)); err != nil {
-			log.Printf("Failed to truncate remote file: %v", err)
-			return fuse.EIO
+		if err != nil {
+			log.Printf("failed to truncate remote file '%s': %v", remotePath, err)
+			return errno(err)
 		}
-
-		attrs.Size = *op.Size
 	}
 	if op.Mode != nil {
-		attrs.Mode = *op.Mode
+		if fhandle != nil {
+			err = fhandle.Chmod(*op.Mode)
+		} else {
+			err = client.Chmod(remotePath, *op.Mode)
+		}
+		if err != nil {
+			log.Printf("failed to chmod remote file '%s': %v", remotePath, err)
+			return errno(err)
+		}
 	}
-	if op.Atime != nil {
-		attrs.Atime = *op.Atime
+	if op.Atime != nil || op.Mtime != nil {
+		// SFTP always sets both times, so the one that isn't changing keeps
+		// its current value.
+		atime, mtime := attrs.Atime, attrs.Mtime
+		if op.Atime != nil {
+			atime = *op.Atime
+		}
+		if op.Mtime != nil {
+			mtime = *op.Mtime
+		}
+
+		if err := client.Chtimes(remotePath, atime, mtime); err != nil {
+			log.Printf("failed to set times of remote file '%s': %v", remotePath, err)
+			return errno(err)
+		}
 	}
-	if op.Mtime != nil {
-		attrs.Atime = *op.Mtime
+
+	if err := fs.refreshAttributes(client, in); err != nil {
+		log.Printf("failed to stat remote file '%s': %v", remotePath, err)
+		return errno(err)
 	}
 
 	op.Attributes = *attrs
-	op.AttributesExpiration = time.Now().Add(time.Second * 10) // TODO remove hardcoding
+	op.AttributesExpiration = time.Now().Add(fs.attrTimeout)
 
 	return nil
 }
@@ -140,35 +246,22 @@ func (fs *filesystem) ForgetInode(ctx context.Context, op *fuseops.ForgetInodeOp
 
 	log.Printf("ForgetInode[InodeID: %v, N: %v]", op.Inode, op.N)
 
-	in, ok := fs.inodes[op.Inode]
-	if !ok {
-		return nil
-	}
-
-	remotePath := in.RemotePath()
-
-	switch in.(type) {
-	case inode.FileInode:
-		if err := fs.sftpClient.Remove(remotePath); err != nil {
-			log.Printf("failed to delete remote file '%s': %v", remotePath, err)
-			return fuse.EIO
-		}
-	case inode.DirInode:
-		if err := fs.sftpClient.RemoveDirectory(remotePath); err != nil {
-			log.Printf("failed to delete remote dir '%s': %v", remotePath, err)
-			return fuse.EIO
-		}
-	}
+	fs.forget(op.Inode, op.N)
 
 	return nil
 }
 
-func (fs *filesystem) BatchForget(context.Context, *fuseops.BatchForgetOp) error {
+func (fs *filesystem) BatchForget(ctx context.Context, op *fuseops.BatchForgetOp) error {
 	fs.Lock()
 	defer fs.Unlock()
 
-	log.Println("BatchForget")
-	return fuse.ENOSYS
+	log.Printf("BatchForget[Entries: %v]", len(op.Entries))
+
+	for _, entry := range op.Entries {
+		fs.forget(entry.Inode, entry.N)
+	}
+
+	return nil
 }
 
 func (fs *filesystem) MkDir(ctx context.Context, op *fuseops.MkDirOp) error {
@@ -187,38 +280,48 @@ func (fs *filesystem) MkDir(ctx context.Context, op *fuseops.MkDirOp) error {
 		return fuse.EINVAL
 	}
 
-	if in := parent.LookUpChild(ctx, op.Name); in != nil {
+	if in, err := parent.LookUpChild(ctx, op.Name); err != nil {
+		log.Printf("failed to look up '%s': %v", op.Name, err)
+		return errno(err)
+	} else if in != nil {
 		return fuse.EEXIST
 	}
 
-	attrs := fuseops.InodeAttributes{
-		Size:  4096,
-		Nlink: 1,
-		Uid:   fs.uid,
-		Gid:   fs.gid,
-		Mode:  op.Mode,
+	remotePath := path.Join(parent.RemotePath(), op.Name)
 
-		Atime:  time.Now(),
-		Ctime:  time.Now(),
-		Mtime:  time.Now(),
-		Crtime: time.Now(),
+	client, err := fs.conn.Client()
+	if err != nil {
+		return errno(err)
 	}
 
-	remotePath := path.Join(parent.RemotePath(), op.Name)
-
-	if err := fs.sftpClient.Mkdir(remotePath); err != nil {
-		return fuse.EIO
+	if err := client.Mkdir(remotePath); err != nil {
+		log.Printf("failed to create remote dir '%s': %v", remotePath, err)
+		return errno(err)
 	}
 
-	dnode := inode.NewDir(fs.nextInodeID(), &attrs, remotePath, fs.sftpClient)
-	fs.inodes[dnode.InodeID()] = dnode
-	parent.AddEntry(dnode.Name(), dnode)
+	// SFTP creates directories with the server's default mode, which must
+	// not stay behind when the caller asked for a more private one.
+	if err := client.Chmod(remotePath, op.Mode); err != nil {
+		log.Printf("failed to chmod remote dir '%s': %v", remotePath, err)
+		client.RemoveDirectory(remotePath)
+		return errno(err)
+	}
 
-	op.Entry = fuseops.ChildInodeEntry{
-		Child:      dnode.InodeID(),
-		Attributes: attrs,
+	info, err := client.Stat(remotePath)
+	if err != nil {
+		log.Printf("failed to stat remote dir '%s': %v", remotePath, err)
+		return errno(err)
 	}
 
+	attrs := inode.Attributes(info, fs.ids)
+
+	dnode := inode.NewDir(0, &attrs, remotePath, fs.conn, fs.ids, fs.dirCacheTTL)
+	fs.clearMissing(op.Parent, op.Name)
+	fs.lookedUp(dnode)
+	parent.AddEntry(op.Name, dnode)
+
+	op.Entry = fs.childEntry(dnode)
+
 	return nil
 }
 
@@ -246,61 +349,171 @@ func (fs *filesystem) CreateFile(ctx context.Context, op *fuseops.CreateFileOp)
 		return fuse.EINVAL
 	}
 
-	if in := parent.LookUpChild(ctx, op.Name); in != nil {
+	if in, err := parent.LookUpChild(ctx, op.Name); err != nil {
+		log.Printf("failed to look up '%s': %v", op.Name, err)
+		return errno(err)
+	} else if in != nil {
 		return fuse.EEXIST
 	}
 
-	attrs := fuseops.InodeAttributes{
-		Size:  0,
-		Nlink: 1,
-		Uid:   fs.uid,
-		Gid:   fs.gid,
-		Mode:  op.Mode,
+	remotePath := path.Join(parent.RemotePath(), op.Name)
+
+	attrs := fuseops.InodeAttributes{}
+	fnode := inode.NewFile(0, &attrs, remotePath)
 
-		Atime:  time.Now(),
-		Ctime:  time.Now(),
-		Mtime:  time.Now(),
-		Crtime: time.Now(),
+	fh, err := handle.OpenFileHandle(fs.conn, fnode.(inode.FileInode), os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		log.Printf("failed to open remote file: %v", err)
+		return errno(err)
 	}
 
-	remotePath := path.Join(parent.RemotePath(), op.Name)
+	client, err := fs.conn.Client()
+	if err != nil {
+		fh.(handle.FileHandle).CloseRemoteFile()
+		return errno(err)
+	}
 
-	fnode := inode.NewFile(fs.nextInodeID(), &attrs, remotePath)
+	// Like MkDir, the file starts out with the server's default mode.
+	if err := fh.(handle.FileHandle).Chmod(op.Mode); err != nil {
+		log.Printf("failed to chmod remote file '%s': %v", remotePath, err)
+		fh.(handle.FileHandle).CloseRemoteFile()
+		client.Remove(remotePath)
+		return errno(err)
+	}
 
-	f, err := fs.sftpClient.OpenFile(fnode.RemotePath(), os.O_CREATE|os.O_RDWR)
+	info, err := client.Stat(remotePath)
 	if err != nil {
-		log.Printf("failed to open remote file: %v", err)
-		return fuse.EIO
+		log.Printf("failed to stat remote file '%s': %v", remotePath, err)
+		fh.(handle.FileHandle).CloseRemoteFile()
+		return errno(err)
 	}
 
-	parent.AddEntry(fnode.Name(), fnode)
-	fs.inodes[fnode.InodeID()] = fnode
+	attrs = inode.Attributes(info, fs.ids)
+
+	parent.AddEntry(op.Name, fnode)
+	fs.clearMissing(op.Parent, op.Name)
+	fs.lookedUp(fnode)
 
 	op.Handle = fs.nextHandleID()
-	fs.handles[op.Handle] = handle.NewFileHandle(fnode.(inode.FileInode), f)
+	fs.handles[op.Handle] = fh
 
-	op.Entry = fuseops.ChildInodeEntry{
-		Child:      fnode.InodeID(),
-		Attributes: attrs,
-	}
+	op.Entry = fs.childEntry(fnode)
 
 	return nil
 }
 
-func (fs *filesystem) CreateLink(context.Context, *fuseops.CreateLinkOp) error {
+func (fs *filesystem) CreateLink(ctx context.Context, op *fuseops.CreateLinkOp) error {
 	fs.Lock()
 	defer fs.Unlock()
 
-	log.Println("CreateLink")
-	return fuse.ENOSYS
+	log.Printf("CreateLink[Parent: %v, Name: %v, Target: %v]", op.Parent, op.Name, op.Target)
+
+	target, ok := fs.inodes[op.Target]
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	if _, ok := target.(inode.DirInode); ok {
+		return syscall.EPERM
+	}
+
+	in, ok := fs.inodes[op.Parent]
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	parent, ok := in.(inode.DirInode)
+	if !ok {
+		return fuse.EINVAL
+	}
+
+	if in, err := parent.LookUpChild(ctx, op.Name); err != nil {
+		log.Printf("failed to look up '%s': %v", op.Name, err)
+		return errno(err)
+	} else if in != nil {
+		return fuse.EEXIST
+	}
+
+	client, err := fs.conn.Client()
+	if err != nil {
+		return errno(err)
+	}
+
+	remotePath := path.Join(parent.RemotePath(), op.Name)
+	if err := client.Link(target.RemotePath(), remotePath); err != nil {
+		log.Printf("failed to link '%s' to '%s': %v", remotePath, target.RemotePath(), err)
+		return errno(err)
+	}
+
+	if err := fs.refreshAttributes(client, target); err != nil {
+		log.Printf("failed to stat remote file '%s': %v", remotePath, err)
+	}
+
+	attrs := target.GetAttributes()
+	if attrs.Nlink == 0 {
+		attrs.Nlink = 1
+	}
+	attrs.Nlink++
+
+	fs.addLink(target, remotePath)
+	parent.AddEntry(op.Name, target)
+	fs.clearMissing(op.Parent, op.Name)
+	fs.lookedUp(target)
+
+	op.Entry = fs.childEntry(target)
+
+	return nil
 }
 
-func (fs *filesystem) CreateSymlink(context.Context, *fuseops.CreateSymlinkOp) error {
+func (fs *filesystem) CreateSymlink(ctx context.Context, op *fuseops.CreateSymlinkOp) error {
 	fs.Lock()
 	defer fs.Unlock()
 
-	log.Println("CreateSymlink")
-	return fuse.ENOSYS
+	log.Printf("CreateSymlink[Parent: %v, Name: %v, Target: %v]", op.Parent, op.Name, op.Target)
+
+	in, ok := fs.inodes[op.Parent]
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	parent, ok := in.(inode.DirInode)
+	if !ok {
+		return fuse.EINVAL
+	}
+
+	if in, err := parent.LookUpChild(ctx, op.Name); err != nil {
+		log.Printf("failed to look up '%s': %v", op.Name, err)
+		return errno(err)
+	} else if in != nil {
+		return fuse.EEXIST
+	}
+
+	client, err := fs.conn.Client()
+	if err != nil {
+		return errno(err)
+	}
+
+	remotePath := path.Join(parent.RemotePath(), op.Name)
+	if err := client.Symlink(op.Target, remotePath); err != nil {
+		log.Printf("failed to create remote link '%s': %v", remotePath, err)
+		return errno(err)
+	}
+
+	info, err := client.Lstat(remotePath)
+	if err != nil {
+		log.Printf("failed to stat remote link '%s': %v", remotePath, err)
+		return errno(err)
+	}
+
+	attrs := inode.Attributes(info, fs.ids)
+	snode := inode.NewSymlink(0, &attrs, remotePath, op.Target, fs.conn)
+	parent.AddEntry(op.Name, snode)
+	fs.clearMissing(op.Parent, op.Name)
+	fs.lookedUp(snode)
+
+	op.Entry = fs.childEntry(snode)
+
+	return nil
 }
 
 func (fs *filesystem) Rename(ctx context.Context, op *fuseops.RenameOp) error {
@@ -332,25 +545,126 @@ func (fs *filesystem) Rename(ctx context.Context, op *fuseops.RenameOp) error {
 		return fuse.EINVAL
 	}
 
-	toMoveNode := oldParent.LookUpChild(ctx, op.OldName)
+	toMoveNode, err := oldParent.LookUpChild(ctx, op.OldName)
+	if err != nil {
+		log.Printf("failed to look up '%s': %v", op.OldName, err)
+		return errno(err)
+	}
 	if toMoveNode == nil {
 		return fuse.ENOENT
 	}
 
-	oldPath := toMoveNode.RemotePath()
+	replaced, err := newParent.LookUpChild(ctx, op.NewName)
+	if err != nil {
+		log.Printf("failed to look up '%s': %v", op.NewName, err)
+		return errno(err)
+	}
+	if replaced == toMoveNode {
+		// Both names are links to the same file, which rename(2) leaves alone.
+		return nil
+	}
+	if replaced != nil {
+		if err := fs.checkReplace(ctx, toMoveNode, replaced); err != nil {
+			return err
+		}
+	}
+
+	client, err := fs.conn.Client()
+	if err != nil {
+		return errno(err)
+	}
+
+	// The kernel has no way to pass RENAME_NOREPLACE or RENAME_EXCHANGE to
+	// this version of the fuse package, so only plain renames arrive here.
+	oldPath := path.Join(oldParent.RemotePath(), op.OldName)
 	newPath := path.Join(newParent.RemotePath(), op.NewName)
-	if err := fs.sftpClient.Rename(oldPath, newPath); err != nil {
-		log.Printf("failed to move remote file '%s' to '%s'", oldPath, newPath)
-		return fuse.EIO
+
+	// An empty directory may only be replaced once its sidecar is gone. The
+	// attributes are put back if the rename fails.
+	var replacedXattrs map[string][]byte
+	if _, ok := replaced.(inode.DirInode); ok {
+		replacedXattrs = fs.takeXattrs(xattr.DirKey(newPath))
+	}
+
+	// Like for unlink(2), handles open for the replaced file must keep
+	// working, so it is moved out of sight first.
+	hidden := false
+	if replaced != nil && replaced.GetAttributes().Nlink <= 1 && fs.openFileHandles(replaced.InodeID()) > 0 {
+		if err := fs.hide(client, replaced, newPath); err != nil {
+			log.Printf("failed to hide remote file '%s': %v", newPath, err)
+			return errno(err)
+		}
+		hidden = true
 	}
 
-	toMoveNode.SetRemotePath(newPath)
+	if _, ok := client.HasExtension(posixRenameExtension); ok {
+		err = client.PosixRename(oldPath, newPath)
+	} else {
+		// Plain SFTP renames fail if the destination exists, so it has to go
+		// first. Unlike rename(2) this isn't atomic.
+		if replaced != nil && !hidden {
+			if _, ok := replaced.(inode.DirInode); ok {
+				err = client.RemoveDirectory(newPath)
+			} else {
+				err = client.Remove(newPath)
+			}
+		}
+		if err == nil {
+			err = client.Rename(oldPath, newPath)
+		}
+	}
+	if err != nil {
+		log.Printf("failed to move remote file '%s' to '%s': %v", oldPath, newPath, err)
+		fs.restoreXattrs(xattr.DirKey(newPath), replacedXattrs)
+		if hidden {
+			fs.unhide(client, replaced, newPath)
+		}
+		return errno(err)
+	}
+
+	if replaced != nil {
+		fs.replaced(replaced, newPath)
+	}
+
+	if _, ok := toMoveNode.(inode.DirInode); !ok {
+		if err := fs.xattrs.Move(xattr.FileKey(oldPath), xattr.FileKey(newPath)); err != nil {
+			log.Printf("failed to move extended attributes of '%s': %v", oldPath, err)
+		}
+	}
+
+	fs.renamed(toMoveNode, oldPath, newPath)
+	fs.clearMissing(op.NewParent, op.NewName)
 	newParent.AddEntry(op.NewName, toMoveNode)
 	oldParent.RemoveEntry(op.OldName)
 
 	return nil
 }
 
+// checkReplace returns the error rename(2) gives when in can't take the place
+// of replaced.
+func (fs *filesystem) checkReplace(ctx context.Context, in, replaced inode.Inode) error {
+	_, isDir := in.(inode.DirInode)
+	replacedDir, replacesDir := replaced.(inode.DirInode)
+
+	switch {
+	case isDir && !replacesDir:
+		return syscall.ENOTDIR
+	case !isDir && replacesDir:
+		return syscall.EISDIR
+	case replacesDir:
+		entries, err := replacedDir.GetEntries(ctx)
+		if err != nil {
+			log.Printf("failed to list '%s': %v", replacedDir.RemotePath(), err)
+			return errno(err)
+		}
+		if len(entries) > 0 {
+			return fuse.ENOTEMPTY
+		}
+	}
+
+	return nil
+}
+
 func (fs *filesystem) RmDir(ctx context.Context, op *fuseops.RmDirOp) error {
 	fs.Lock()
 	defer fs.Unlock()
@@ -367,7 +681,11 @@ func (fs *filesystem) RmDir(ctx context.Context, op *fuseops.RmDirOp) error {
 		return fuse.EINVAL
 	}
 
-	child := parent.LookUpChild(ctx, op.Name)
+	child, err := parent.LookUpChild(ctx, op.Name)
+	if err != nil {
+		log.Printf("failed to look up '%s': %v", op.Name, err)
+		return errno(err)
+	}
 	if child == nil {
 		return fuse.ENOENT
 	}
@@ -378,12 +696,38 @@ func (fs *filesystem) RmDir(ctx context.Context, op *fuseops.RmDirOp) error {
 	}
 	entries, err := dnode.GetEntries(ctx)
 	if err != nil {
-		return fuse.EIO
+		log.Printf("failed to list '%s': %v", op.Name, err)
+		return errno(err)
 	}
 	if len(entries) > 0 {
 		return fuse.ENOTEMPTY
 	}
 
+	client, err := fs.conn.Client()
+	if err != nil {
+		return errno(err)
+	}
+
+	// The sidecar lives in the directory and has to go first, but must come
+	// back if the directory turns out not to be empty after all.
+	remotePath := dnode.RemotePath()
+	key := xattr.DirKey(remotePath)
+	xattrs := fs.takeXattrs(key)
+
+	if err := client.RemoveDirectory(remotePath); err != nil {
+		log.Printf("failed to delete remote dir '%s': %v", remotePath, err)
+		fs.restoreXattrs(key, xattrs)
+
+		// Servers answer SSH_FX_FAILURE for directories that still have
+		// entries, e.g. hidden ones or ones created by somebody else.
+		var statusErr *sftp.StatusError
+		if errors.As(err, &statusErr) && statusErr.FxCode() == sftp.ErrSSHFxFailure {
+			return fuse.ENOTEMPTY
+		}
+
+		return errno(err)
+	}
+
 	parent.RemoveEntry(op.Name)
 
 	return nil
@@ -404,10 +748,47 @@ func (fs *filesystem) Unlink(ctx context.Context, op *fuseops.UnlinkOp) error {
 		return fuse.EINVAL
 	}
 
-	if c := parent.LookUpChild(ctx, op.Name); c == nil {
+	child, err := parent.LookUpChild(ctx, op.Name)
+	if err != nil {
+		log.Printf("failed to look up '%s': %v", op.Name, err)
+		return errno(err)
+	}
+	if child == nil {
 		return fuse.ENOENT
-	} else {
-		c.GetAttributes().Nlink--
+	}
+
+	client, err := fs.conn.Client()
+	if err != nil {
+		return errno(err)
+	}
+
+	remotePath := path.Join(parent.RemotePath(), op.Name)
+	if child.GetAttributes().Nlink > 1 {
+		// Other names keep the remote file alive, so only this one goes.
+		if err := client.Remove(remotePath); err != nil {
+			log.Printf("failed to delete remote link '%s': %v", remotePath, err)
+			return errno(err)
+		}
+
+		fs.removeLink(child, remotePath)
+	} else if fs.openFileHandles(child.InodeID()) > 0 {
+		// Open handles must keep working after unlink(2), so the file is
+		// only moved out of sight until the last handle is released.
+		if err := fs.hide(client, child, remotePath); err != nil {
+			log.Printf("failed to hide remote file '%s': %v", remotePath, err)
+			return errno(err)
+		}
+	} else if err := client.Remove(remotePath); err != nil {
+		log.Printf("failed to delete remote file '%s': %v", remotePath, err)
+		return errno(err)
+	}
+
+	if err := fs.xattrs.Delete(xattr.FileKey(remotePath)); err != nil {
+		log.Printf("failed to delete extended attributes of '%s': %v", remotePath, err)
+	}
+
+	if attrs := child.GetAttributes(); attrs.Nlink > 0 {
+		attrs.Nlink--
 	}
 
 	parent.RemoveEntry(op.Name)
@@ -434,6 +815,8 @@ func (fs *filesystem) OpenDir(ctx context.Context, op *fuseops.OpenDirOp) error
 		return fuse.EINVAL
 	}
 
+	fs.touch(op.Inode)
+
 	op.Handle = fs.nextHandleID()
 	fs.handles[op.Handle] = handle.NewDirHandle(dirInode)
 
@@ -463,7 +846,8 @@ func (fs *filesystem) ReadDir(ctx context.Context, op *fuseops.ReadDirOp) error
 	}
 
 	if err := dirHandle.ReadDir(ctx, op); err != nil {
-		return fuse.EIO
+		log.Printf("read dir failed: %v", err)
+		return errno(err)
 	}
 
 	return nil
@@ -505,14 +889,13 @@ func (fs *filesystem) OpenFile(ctx context.Context, op *fuseops.OpenFileOp) erro
 		return fuse.EIO
 	}
 
-	remotePath := fnode.RemotePath()
-	f, err := fs.sftpClient.OpenFile(remotePath, int(op.OpenFlags))
+	fh, err := handle.OpenFileHandle(fs.conn, fnode, int(op.OpenFlags))
 	if err != nil {
-		log.Printf("failed to open remote file '%v': %v", remotePath, err)
-		return fuse.EIO
+		log.Printf("failed to open remote file '%v': %v", fnode.RemotePath(), err)
+		return errno(err)
 	}
 
-	fs.handles[op.Handle] = handle.NewFileHandle(fnode, f)
+	fs.handles[op.Handle] = fh
 
 	return nil
 }
@@ -542,7 +925,7 @@ func (fs *filesystem) ReadFile(ctx context.Context, op *fuseops.ReadFileOp) erro
 
 	if err := fileHandle.ReadFile(ctx, op); err != nil {
 		log.Printf("read file failed: %v", err)
-		return fuse.EIO
+		return errno(err)
 	}
 
 	return nil
@@ -571,9 +954,11 @@ func (fs *filesystem) WriteFile(ctx context.Context, op *fuseops.WriteFileOp) er
 		return fuse.EINVAL
 	}
 
+	fs.written[op.Handle] = true
+
 	if err := fileHandle.WriteFile(ctx, op); err != nil {
 		log.Printf("write file failed: %v", err)
-		return fuse.EIO
+		return errno(err)
 	}
 
 	return nil
@@ -585,7 +970,22 @@ func (fs *filesystem) SyncFile(ctx context.Context, op *fuseops.SyncFileOp) erro
 	defer fs.Unlock()
 
 	log.Printf("SyncFile[InodeID: %v, HandleID: %v]", op.Inode, op.Handle)
-	return nil // TODO implement proper
+
+	fhandle, err := fs.fileHandle(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	err = fhandle.Sync()
+	if errors.Is(err, handle.ErrSyncUnsupported) && !fs.strictSync {
+		return nil
+	}
+	if err != nil {
+		log.Printf("sync file failed: %v", err)
+		return errno(err)
+	}
+
+	return nil
 }
 
 // FlushFile ...
@@ -594,7 +994,57 @@ func (fs *filesystem) FlushFile(ctx context.Context, op *fuseops.FlushFileOp) er
 	defer fs.Unlock()
 
 	log.Printf("FlushFile[InodeID: %v, HandleID: %v]", op.Inode, op.Handle)
-	return nil // TODO implement proper
+
+	fhandle, err := fs.fileHandle(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	if err := fhandle.Flush(); err != nil {
+		log.Printf("flush file failed: %v", err)
+		return errno(err)
+	}
+
+	// The writes changed the size and modification time on the server.
+	fs.refreshAfterWrite(fs.handles[op.Handle].Inode())
+	delete(fs.written, op.Handle)
+
+	return nil
+}
+
+// refreshAfterWrite picks up the attributes the server gave in after its
+// file was written through the mount. Failing to do so only leaves the old
+// attributes around until they time out.
+func (fs *filesystem) refreshAfterWrite(in inode.Inode) {
+	if in.GetAttributes().Nlink == 0 {
+		return
+	}
+
+	client, err := fs.conn.Client()
+	if err != nil {
+		return
+	}
+
+	if err := fs.refreshAttributes(client, in); err != nil {
+		log.Printf("failed to stat remote file '%s': %v", in.RemotePath(), err)
+	}
+}
+
+// fileHandle returns the open file handle with the given ID.
+func (fs *filesystem) fileHandle(id fuseops.HandleID) (handle.FileHandle, error) {
+	h, ok := fs.handles[id]
+	if !ok {
+		log.Println("invalid arg - no handle found")
+		return nil, fuse.EINVAL
+	}
+
+	fhandle, ok := h.(handle.FileHandle)
+	if !ok {
+		log.Println("invalid arg - not a file handle")
+		return nil, fuse.EINVAL
+	}
+
+	return fhandle, nil
 }
 
 // ReleaseFileHandle ...
@@ -619,51 +1069,250 @@ func (fs *filesystem) ReleaseFileHandle(ctx context.Context, op *fuseops.Release
 	}
 
 	delete(fs.handles, op.Handle)
+	delete(fs.written, op.Handle)
+
+	in := h.Inode()
+	fs.refreshAfterWrite(in)
+
+	if fs.unlinked[in.InodeID()] && fs.openFileHandles(in.InodeID()) == 0 {
+		delete(fs.unlinked, in.InodeID())
+
+		client, err := fs.conn.Client()
+		if err != nil {
+			log.Printf("failed to delete unlinked file '%s': %v", in.RemotePath(), err)
+			return nil
+		}
+
+		if err := client.Remove(in.RemotePath()); err != nil {
+			log.Printf("failed to delete unlinked file '%s': %v", in.RemotePath(), err)
+		}
+	}
 
 	return nil
 }
 
 // MISC OPS
 
-func (fs *filesystem) ReadSymlink(context.Context, *fuseops.ReadSymlinkOp) error {
+func (fs *filesystem) ReadSymlink(ctx context.Context, op *fuseops.ReadSymlinkOp) error {
 	fs.Lock()
 	defer fs.Unlock()
 
-	log.Println("ReadSymlink")
-	return fuse.ENOSYS
+	log.Printf("ReadSymlink[Inode: %v]", op.Inode)
+
+	in, ok := fs.inodes[op.Inode]
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	snode, ok := in.(inode.SymlinkInode)
+	if !ok {
+		return fuse.EINVAL
+	}
+
+	target, err := snode.Target()
+	if err != nil {
+		log.Printf("read symlink failed: %v", err)
+		return errno(err)
+	}
+
+	op.Target = fs.symlinkTarget(snode.RemotePath(), target)
+
+	return nil
 }
 
-func (fs *filesystem) RemoveXattr(context.Context, *fuseops.RemoveXattrOp) error {
+func (fs *filesystem) RemoveXattr(ctx context.Context, op *fuseops.RemoveXattrOp) error {
 	fs.Lock()
 	defer fs.Unlock()
 
-	log.Println("RemoveXattr")
-	return fuse.ENOSYS
+	log.Printf("RemoveXattr[Inode: %v, Name: %v]", op.Inode, op.Name)
+
+	in, ok := fs.inodes[op.Inode]
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	if err := fs.xattrs.Remove(xattrKey(in), op.Name); err != nil {
+		log.Printf("failed to remove extended attribute '%s': %v", op.Name, err)
+		return errno(err)
+	}
+
+	return nil
 }
-func (fs *filesystem) GetXattr(context.Context, *fuseops.GetXattrOp) error {
+
+func (fs *filesystem) GetXattr(ctx context.Context, op *fuseops.GetXattrOp) error {
 	fs.Lock()
 	defer fs.Unlock()
 
-	log.Println("GetXattr")
-	return fuse.ENOSYS
+	log.Printf("GetXattr[Inode: %v, Name: %v]", op.Inode, op.Name)
+
+	in, ok := fs.inodes[op.Inode]
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	value, err := fs.xattrs.Get(xattrKey(in), op.Name)
+	if err != nil {
+		return errno(err)
+	}
+
+	// An empty buffer asks for the size only.
+	op.BytesRead = len(value)
+	if len(op.Dst) == 0 {
+		return nil
+	}
+	if len(op.Dst) < len(value) {
+		return syscall.ERANGE
+	}
+
+	copy(op.Dst, value)
+
+	return nil
 }
-func (fs *filesystem) ListXattr(context.Context, *fuseops.ListXattrOp) error {
+
+func (fs *filesystem) ListXattr(ctx context.Context, op *fuseops.ListXattrOp) error {
 	fs.Lock()
 	defer fs.Unlock()
 
-	log.Println("ListXattr")
-	return fuse.ENOSYS
+	log.Printf("ListXattr[Inode: %v]", op.Inode)
+
+	in, ok := fs.inodes[op.Inode]
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	names, err := fs.xattrs.List(xattrKey(in))
+	if err != nil {
+		return errno(err)
+	}
+
+	var list []byte
+	for _, name := range names {
+		list = append(append(list, name...), 0)
+	}
+
+	op.BytesRead = len(list)
+	if len(op.Dst) == 0 {
+		return nil
+	}
+	if len(op.Dst) < len(list) {
+		return syscall.ERANGE
+	}
+
+	copy(op.Dst, list)
+
+	return nil
 }
-func (fs *filesystem) SetXattr(context.Context, *fuseops.SetXattrOp) error {
+
+func (fs *filesystem) SetXattr(ctx context.Context, op *fuseops.SetXattrOp) error {
 	fs.Lock()
 	defer fs.Unlock()
 
-	log.Println("SetXattr")
-	return fuse.ENOSYS
+	log.Printf("SetXattr[Inode: %v, Name: %v, Flags: %v]", op.Inode, op.Name, op.Flags)
+
+	in, ok := fs.inodes[op.Inode]
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	key := xattrKey(in)
+
+	if op.Flags&(xattrCreate|xattrReplace) != 0 {
+		_, err := fs.xattrs.Get(key, op.Name)
+		switch {
+		case err == nil && op.Flags&xattrCreate != 0:
+			return fuse.EEXIST
+		case errors.Is(err, xattr.ErrNoAttr) && op.Flags&xattrReplace != 0:
+			return fuse.ENOATTR
+		case err != nil && !errors.Is(err, xattr.ErrNoAttr):
+			return errno(err)
+		}
+	}
+
+	if err := fs.xattrs.Set(key, op.Name, op.Value); err != nil {
+		log.Printf("failed to set extended attribute '%s': %v", op.Name, err)
+		return errno(err)
+	}
+
+	return nil
 }
-func (fs *filesystem) Fallocate(context.Context, *fuseops.FallocateOp) error {
-	log.Println("Fallocate")
-	return fuse.ENOSYS
+func (fs *filesystem) Fallocate(ctx context.Context, op *fuseops.FallocateOp) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	log.Printf(
+		"Fallocate[Inode: %v, Handle: %v, Offset: %v, Length: %v, Mode: %v]",
+		op.Inode, op.Handle, op.Offset, op.Length, op.Mode,
+	)
+
+	in, ok := fs.inodes[op.Inode]
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	fhandle, err := fs.fileHandle(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	switch op.Mode {
+	case 0, fallocPunchHole | fallocKeepSize:
+	case fallocKeepSize:
+		// SFTP can't reserve space, and the size stays, so there is
+		// nothing to do.
+		return nil
+	default:
+		return syscall.EOPNOTSUPP
+	}
+
+	client, err := fs.conn.Client()
+	if err != nil {
+		return errno(err)
+	}
+
+	if err := fs.flushFileHandles(op.Inode); err != nil {
+		log.Printf("failed to flush remote file '%s': %v", in.RemotePath(), err)
+		return errno(err)
+	}
+
+	if err := fs.refreshAttributes(client, in); err != nil {
+		log.Printf("failed to stat remote file '%s': %v", in.RemotePath(), err)
+		return errno(err)
+	}
+
+	size := in.GetAttributes().Size
+	end := op.Offset + op.Length
+
+	if op.Mode == 0 {
+		// Growing the file leaves a hole on most servers rather than
+		// allocating blocks, but the size is what callers rely on.
+		if end <= size {
+			return nil
+		}
+
+		err = fhandle.Truncate(int64(end))
+	} else {
+		// Without a way to deallocate, the range is zeroed instead. Nothing
+		// beyond the end of the file is written, so the size stays.
+		if end > size {
+			end = size
+		}
+		if op.Offset >= end {
+			return nil
+		}
+
+		err = fhandle.ZeroRange(int64(op.Offset), int64(end-op.Offset))
+	}
+	if err != nil {
+		log.Printf("fallocate failed: %v", err)
+		return errno(err)
+	}
+
+	if err := fs.refreshAttributes(client, in); err != nil {
+		log.Printf("failed to stat remote file '%s': %v", in.RemotePath(), err)
+		return errno(err)
+	}
+
+	return nil
 }
 
 // decremented to zero, and clean up any resources associated with the file
@@ -673,4 +1322,5 @@ func (fs *filesystem) Destroy() {
 	defer fs.Unlock()
 
 	log.Println("Destroy")
+	close(fs.done)
 }
@@ -0,0 +1,217 @@
+package filesystem
+
+import (
+	"log"
+	"os"
+	"sftpfs/handle"
+	"sftpfs/inode"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// hotWindow is how long a directory is watched after it was last used.
+const hotWindow = time.Minute
+
+// invalidation is an inode, or a name in a directory if name is set, whose
+// kernel cache has to go.
+type invalidation struct {
+	id   fuseops.InodeID
+	name string
+}
+
+// watched is an inode the poller checks, together with the remote path it had
+// and the time its attributes were fetched when the check started.
+type watched struct {
+	in         inode.Inode
+	remotePath string
+	fetched    time.Time
+}
+
+func watch(in inode.Inode) watched {
+	return watched{in: in, remotePath: in.RemotePath(), fetched: in.AttributesTime()}
+}
+
+// poll checks the hot directories and the open files for changes made on the
+// server every interval, until the file system is destroyed.
+//
+// The caches of the file system are updated right away. The kernel is told
+// to drop its own through the Notifier; without one it picks up the changes
+// once its entries and attributes expire, and drops the page cache of a file
+// when it is opened again.
+func (fs *filesystem) poll(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-fs.done:
+			return
+		}
+
+		fs.checkRemoteChanges()
+	}
+}
+
+// touch marks the directory as in use, so that the poller watches it.
+func (fs *filesystem) touch(id fuseops.InodeID) {
+	fs.hot[id] = time.Now()
+}
+
+func (fs *filesystem) checkRemoteChanges() {
+	fs.Lock()
+	targets := fs.watchList()
+	fs.Unlock()
+
+	if len(targets) == 0 {
+		return
+	}
+
+	client, err := fs.conn.Client()
+	if err != nil {
+		return
+	}
+
+	infos := make([]os.FileInfo, len(targets))
+	for i, t := range targets {
+		info, err := client.Lstat(t.remotePath)
+		if err != nil {
+			continue
+		}
+
+		infos[i] = info
+	}
+
+	var invalidations []invalidation
+
+	fs.Lock()
+	for i, t := range targets {
+		// Skip what vanished, or was renamed or forgotten in the meantime.
+		if infos[i] == nil || t.in.RemotePath() != t.remotePath || fs.inodes[t.in.InodeID()] != t.in {
+			continue
+		}
+
+		// Attributes fetched after the stat, e.g. after a flush, are at
+		// least as current as it.
+		if !t.in.AttributesTime().Equal(t.fetched) {
+			continue
+		}
+
+		invalidations = append(invalidations, fs.applyRemoteChange(t.in, infos[i])...)
+	}
+	fs.Unlock()
+
+	// The kernel may have to wait for operations in the same directory or
+	// on the same pages, which in turn wait for the lock.
+	fs.notify(invalidations)
+}
+
+// notify passes the invalidations on to the kernel.
+func (fs *filesystem) notify(invalidations []invalidation) {
+	if fs.notifier == nil {
+		return
+	}
+
+	for _, inv := range invalidations {
+		var err error
+		if inv.name == "" {
+			err = fs.notifier.InvalidateInode(inv.id)
+		} else {
+			err = fs.notifier.InvalidateEntry(inv.id, inv.name)
+		}
+
+		if err != nil {
+			log.Printf("failed to invalidate kernel cache of inode %v: %v", inv.id, err)
+		}
+	}
+}
+
+// watchList returns the directories used within hotWindow and the files with
+// open handles that weren't written to since they were last flushed.
+// Directories that cooled down are forgotten. Inodes without links are
+// skipped, as their remote path may belong to another file by now.
+func (fs *filesystem) watchList() []watched {
+	var targets []watched
+
+	for id, used := range fs.hot {
+		in, ok := fs.inodes[id]
+		if !ok || time.Since(used) > hotWindow || in.GetAttributes().Nlink == 0 {
+			delete(fs.hot, id)
+			continue
+		}
+
+		targets = append(targets, watch(in))
+	}
+
+	seen := make(map[fuseops.InodeID]bool)
+	for _, h := range fs.handles {
+		if _, ok := h.(handle.FileHandle); !ok {
+			continue
+		}
+
+		in := h.Inode()
+		if seen[in.InodeID()] || fs.unlinked[in.InodeID()] || in.GetAttributes().Nlink == 0 || fs.writing(in.InodeID()) {
+			continue
+		}
+		seen[in.InodeID()] = true
+
+		targets = append(targets, watch(in))
+	}
+
+	return targets
+}
+
+// writing reports whether a handle open for the inode was written to since it
+// was last flushed. Its remote file would only show the mount's own changes.
+func (fs *filesystem) writing(id fuseops.InodeID) bool {
+	for hid := range fs.written {
+		if h, ok := fs.handles[hid]; ok && h.Inode().InodeID() == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// applyRemoteChange updates the cached attributes of in from a fresh stat and
+// returns what the kernel has to forget. A directory that changed is listed
+// again, and a link is read again.
+func (fs *filesystem) applyRemoteChange(in inode.Inode, info os.FileInfo) []invalidation {
+	attrs := in.GetAttributes()
+
+	_, isDir := in.(inode.DirInode)
+	if info.ModTime().Equal(attrs.Mtime) && (isDir || uint64(info.Size()) == attrs.Size) {
+		return nil
+	}
+
+	log.Printf("remote change detected in '%s'", in.RemotePath())
+
+	inode.UpdateAttributes(in, info, fs.ids)
+
+	invalidations := []invalidation{{id: in.InodeID()}}
+
+	if dir, ok := in.(inode.DirInode); ok {
+		fs.clearMissingIn(in.InodeID())
+
+		changed, err := dir.Refresh()
+		if err != nil {
+			log.Printf("failed to list changed dir '%s': %v", in.RemotePath(), err)
+		}
+
+		for _, entry := range changed {
+			invalidations = append(invalidations, invalidation{id: in.InodeID(), name: entry.Name})
+
+			// An entry that kept its inode may have its data cached.
+			if entry.Inode != nil && entry.Inode.InodeID() >= fuseops.RootInodeID && !fs.writing(entry.Inode.InodeID()) {
+				invalidations = append(invalidations, invalidation{id: entry.Inode.InodeID()})
+			}
+		}
+	}
+
+	if link, ok := in.(inode.SymlinkInode); ok {
+		link.Invalidate()
+	}
+
+	return invalidations
+}
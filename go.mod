@@ -4,6 +4,7 @@ go 1.19
 
 require (
 	github.com/jacobsa/fuse v0.0.0-20220726073400-226fec2ce902
+	github.com/kevinburke/ssh_config v1.2.0
 	github.com/pkg/sftp v1.13.5
 	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e
 	golang.org/x/term v0.0.0-20220722155259-a9ba230a4035
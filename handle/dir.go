@@ -39,18 +39,22 @@ func (dh *dirHandle) ReadDir(ctx context.Context, op *fuseops.ReadDirOp) error {
 	dirents := make([]fuseutil.Dirent, len(entries)) // TODO: add self and parent refs (. / ..)
 	for i, entry := range entries {
 		t := fuseutil.DT_Unknown
-		if _, ok := entry.(inode.DirInode); ok {
+		if _, ok := entry.Inode.(inode.DirInode); ok {
 			t = fuseutil.DT_Directory
 		}
 
-		if _, ok := entry.(inode.FileInode); ok {
+		if _, ok := entry.Inode.(inode.FileInode); ok {
 			t = fuseutil.DT_File
 		}
 
+		if _, ok := entry.Inode.(inode.SymlinkInode); ok {
+			t = fuseutil.DT_Link
+		}
+
 		dirents[i] = fuseutil.Dirent{
 			Type:   t,
 			Inode:  fuseops.RootInodeID + 1,
-			Name:   entry.Name(),
+			Name:   entry.Name,
 			Offset: fuseops.DirOffset(i) + 1,
 		}
 	}
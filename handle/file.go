@@ -2,9 +2,12 @@ package handle
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"os"
 	"sftpfs/inode"
+	"sftpfs/remote"
 
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/pkg/sftp"
@@ -13,26 +16,122 @@ import (
 type FileHandle interface {
 	ReadFile(context.Context, *fuseops.ReadFileOp) error
 	WriteFile(context.Context, *fuseops.WriteFileOp) error
+	Truncate(size int64) error
+	ZeroRange(offset, length int64) error
+	Chmod(mode os.FileMode) error
+	FlushBuffer() error
+	Flush() error
+	Sync() error
 	CloseRemoteFile() error
 }
 
-func NewFileHandle(fnode inode.FileInode, file *sftp.File) Handle {
-	return &fileHandle{file, fnode}
+// ErrSyncUnsupported is returned by Sync if the server can't flush files to
+// stable storage.
+var ErrSyncUnsupported = errors.New("server does not support fsync@openssh.com")
+
+const fsyncExtension = "fsync@openssh.com"
+
+// zeroChunkSize is the size of the writes ZeroRange sends.
+const zeroChunkSize = 1 << 16
+
+// writeBufferSize is how many bytes of sequential writes are collected
+// before they are sent to the server.
+const writeBufferSize = 1 << 20
+
+// OpenFileHandle opens the remote file behind fnode with the given open(2)
+// flags.
+func OpenFileHandle(conn *remote.Conn, fnode inode.FileInode, flags int) (Handle, error) {
+	// The kernel's writeback cache reads whole pages before writing parts of
+	// them and works out append offsets itself, so the remote file should be
+	// readable and must not append on its own.
+	flags &^= os.O_APPEND
+
+	if flags&os.O_WRONLY != 0 {
+		fh := &fileHandle{conn: conn, fileInode: fnode, flags: flags&^os.O_WRONLY | os.O_RDWR}
+		_, err := fh.remoteFile()
+		if err == nil {
+			return fh, nil
+		}
+
+		// Write-only files can still be opened as asked for. Writes to
+		// parts of pages that hold data fail then, as the kernel can't read
+		// the rest of them.
+		if !errors.Is(err, os.ErrPermission) {
+			return nil, err
+		}
+	}
+
+	fh := &fileHandle{conn: conn, fileInode: fnode, flags: flags}
+	if _, err := fh.remoteFile(); err != nil {
+		return nil, err
+	}
+
+	return fh, nil
 }
 
 type fileHandle struct {
-	file      *sftp.File
-	fileInode inode.FileInode
+	file       *sftp.File
+	fileInode  inode.FileInode
+	conn       *remote.Conn
+	flags      int
+	generation uint64
+
+	// buf holds the sequential writes starting at bufOffset that haven't
+	// been sent yet. writeErr keeps the error of a write that failed after
+	// WriteFile already reported success, until Flush reports it.
+	buf       []byte
+	bufOffset int64
+	writeErr  error
 }
 
 func (fh *fileHandle) Inode() inode.Inode {
 	return fh.fileInode
 }
 
+// remoteFile returns the open remote file. After a reconnect the old file
+// handle is gone with the old session, so the file is opened again at the
+// inode's current path.
+func (fh *fileHandle) remoteFile() (*sftp.File, error) {
+	client, generation, err := fh.conn.Session()
+	if err != nil {
+		return nil, err
+	}
+
+	if fh.file != nil && fh.generation == generation {
+		return fh.file, nil
+	}
+
+	flags := fh.flags
+	if fh.file != nil {
+		// The file already exists and must not be truncated a second time.
+		flags &^= os.O_CREATE | os.O_EXCL | os.O_TRUNC
+	}
+
+	remotePath := fh.fileInode.RemotePath()
+	f, err := client.OpenFile(remotePath, flags)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open remote file '%s': %w", remotePath, err)
+	}
+
+	fh.file = f
+	fh.generation = generation
+
+	return f, nil
+}
+
 func (fh *fileHandle) ReadFile(_ context.Context, op *fuseops.ReadFileOp) error {
-	n, err := fh.file.ReadAt(op.Dst, op.Offset)
+	if err := fh.FlushBuffer(); err != nil {
+		return err
+	}
+
+	f, err := fh.remoteFile()
+	if err != nil {
+		return err
+	}
+
+	n, err := f.ReadAt(op.Dst, op.Offset)
 	if err != nil && err != io.EOF {
-		return fmt.Errorf("failed to read network file: %v", err)
+		return fmt.Errorf("failed to read network file: %w", err)
 	}
 
 	op.BytesRead = n
@@ -41,17 +140,151 @@ func (fh *fileHandle) ReadFile(_ context.Context, op *fuseops.ReadFileOp) error
 }
 
 func (fh *fileHandle) WriteFile(_ context.Context, op *fuseops.WriteFileOp) error {
-	if _, err := fh.file.WriteAt(op.Data, op.Offset); err != nil {
-		return fmt.Errorf("failed to write to network file: %v", err)
+	if len(fh.buf) > 0 && op.Offset != fh.bufOffset+int64(len(fh.buf)) {
+		if err := fh.FlushBuffer(); err != nil {
+			return err
+		}
+	}
+
+	if len(fh.buf) == 0 {
+		fh.bufOffset = op.Offset
+	}
+	fh.buf = append(fh.buf, op.Data...)
+
+	if len(fh.buf) >= writeBufferSize {
+		return fh.FlushBuffer()
 	}
 
 	return nil
 }
 
+// FlushBuffer sends the buffered writes to the server. A failure is also
+// kept for the next Flush, since the writes it concerns were already
+// reported as successful.
+func (fh *fileHandle) FlushBuffer() error {
+	if len(fh.buf) == 0 {
+		return nil
+	}
+
+	f, err := fh.remoteFile()
+	if err == nil {
+		_, err = f.WriteAt(fh.buf, fh.bufOffset)
+	}
+
+	fh.buf = fh.buf[:0]
+	if err != nil {
+		err = fmt.Errorf("failed to write to network file: %w", err)
+		fh.writeErr = err
+		return err
+	}
+
+	return nil
+}
+
+// Flush sends the buffered writes to the server and reports any write that
+// failed since the last Flush.
+func (fh *fileHandle) Flush() error {
+	fh.FlushBuffer()
+
+	err := fh.writeErr
+	fh.writeErr = nil
+
+	return err
+}
+
+// Sync flushes the file and asks the server to commit it to stable storage.
+func (fh *fileHandle) Sync() error {
+	if err := fh.Flush(); err != nil {
+		return err
+	}
+
+	client, _, err := fh.conn.Session()
+	if err != nil {
+		return err
+	}
+
+	if _, ok := client.HasExtension(fsyncExtension); !ok {
+		return ErrSyncUnsupported
+	}
+
+	f, err := fh.remoteFile()
+	if err != nil {
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync network file: %w", err)
+	}
+
+	return nil
+}
+
+func (fh *fileHandle) Truncate(size int64) error {
+	if err := fh.FlushBuffer(); err != nil {
+		return err
+	}
+
+	f, err := fh.remoteFile()
+	if err != nil {
+		return err
+	}
+
+	return f.Truncate(size)
+}
+
+// ZeroRange overwrites length bytes at offset with zeros.
+func (fh *fileHandle) ZeroRange(offset, length int64) error {
+	if err := fh.FlushBuffer(); err != nil {
+		return err
+	}
+
+	f, err := fh.remoteFile()
+	if err != nil {
+		return err
+	}
+
+	zeros := make([]byte, zeroChunkSize)
+	for length > 0 {
+		n := int64(len(zeros))
+		if length < n {
+			n = length
+		}
+
+		if _, err := f.WriteAt(zeros[:n], offset); err != nil {
+			return fmt.Errorf("failed to write to network file: %w", err)
+		}
+
+		offset += n
+		length -= n
+	}
+
+	return nil
+}
+
+func (fh *fileHandle) Chmod(mode os.FileMode) error {
+	f, err := fh.remoteFile()
+	if err != nil {
+		return err
+	}
+
+	return f.Chmod(mode)
+}
+
 func (fh *fileHandle) CloseRemoteFile() error {
+	flushErr := fh.Flush()
+
+	if fh.file == nil {
+		return flushErr
+	}
+
+	if _, generation, err := fh.conn.Session(); err != nil || generation != fh.generation {
+		// The file was closed together with the session it belonged to.
+		return flushErr
+	}
+
 	if err := fh.file.Close(); err != nil {
-		return fmt.Errorf("failed to close remote file: %v", err)
+		return fmt.Errorf("failed to close remote file: %w", err)
 	}
 
-	return nil
+	return flushErr
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// defaultKnownHosts returns the path of the user's known_hosts file, or an
+// empty string if the home directory cannot be determined.
+func defaultKnownHosts() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(home, ".ssh", "known_hosts")
+}
+
+// hostKeyChecker verifies server host keys against one or more known_hosts
+// files. Hashed hostnames, @cert-authority and @revoked markers are handled by
+// the knownhosts package.
+type hostKeyChecker struct {
+	files    []string
+	callback ssh.HostKeyCallback
+}
+
+func newHostKeyChecker(files ...string) (*hostKeyChecker, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no known_hosts file given")
+	}
+
+	callback, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load known_hosts: %v", err)
+	}
+
+	return &hostKeyChecker{files: files, callback: callback}, nil
+}
+
+// HostKeyCallback returns an ssh.HostKeyCallback that turns knownhosts errors
+// into messages that tell the user what went wrong.
+func (hkc *hostKeyChecker) HostKeyCallback() ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := hkc.callback(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+
+		var revokedErr *knownhosts.RevokedError
+		if errors.As(err, &revokedErr) {
+			return fmt.Errorf(
+				"host key %s for %s is marked as revoked in %s",
+				ssh.FingerprintSHA256(key), hostname, revokedErr.Revoked.Filename,
+			)
+		}
+
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+
+		if len(keyErr.Want) == 0 {
+			return fmt.Errorf(
+				"host %s is unknown (%s key fingerprint is %s); add it to %v first",
+				hostname, key.Type(), ssh.FingerprintSHA256(key), hkc.files,
+			)
+		}
+
+		want := keyErr.Want[0]
+		return fmt.Errorf(
+			"REMOTE HOST IDENTIFICATION HAS CHANGED for %s: got %s key %s, "+
+				"expected %s key %s (%s:%d); someone could be eavesdropping on you",
+			hostname, key.Type(), ssh.FingerprintSHA256(key),
+			want.Key.Type(), ssh.FingerprintSHA256(want.Key), want.Filename, want.Line,
+		)
+	}
+}
+
+// HostKeyAlgorithms returns the key algorithms already known for addr, so the
+// server is asked for a key type we can actually verify. An empty result
+// means that the library defaults should be used.
+func (hkc *hostKeyChecker) HostKeyAlgorithms(addr string) []string {
+	// Checking a key that is never present makes knownhosts report every
+	// key it does have for the address.
+	err := hkc.callback(addr, &net.TCPAddr{}, probeKey{})
+
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	var algos []string
+	for _, known := range keyErr.Want {
+		for _, algo := range algorithmsForKeyType(known.Key.Type()) {
+			if !seen[algo] {
+				seen[algo] = true
+				algos = append(algos, algo)
+			}
+		}
+	}
+
+	return algos
+}
+
+// algorithmsForKeyType expands RSA keys into the signature algorithms that
+// can be negotiated for them.
+func algorithmsForKeyType(keyType string) []string {
+	if keyType == ssh.KeyAlgoRSA {
+		return []string{ssh.SigAlgoRSASHA2512, ssh.SigAlgoRSASHA2256, ssh.SigAlgoRSA}
+	}
+
+	return []string{keyType}
+}
+
+// probeKey is a public key that never matches a known_hosts entry.
+type probeKey struct{}
+
+func (probeKey) Type() string                            { return "sftpfs-probe" }
+func (probeKey) Marshal() []byte                         { return []byte("sftpfs-probe") }
+func (probeKey) Verify(_ []byte, _ *ssh.Signature) error { return fmt.Errorf("probe key") }
@@ -0,0 +1,182 @@
+package idmap
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// Mapper translates user and group IDs between the server and the local
+// machine.
+type Mapper interface {
+	LocalUID(remote uint32) uint32
+	LocalGID(remote uint32) uint32
+	RemoteUID(local uint32) uint32
+	RemoteGID(local uint32) uint32
+}
+
+// None returns a Mapper that passes IDs through unchanged.
+func None() Mapper {
+	return &tableMapper{}
+}
+
+// User returns a Mapper that maps the IDs of the remote login user to the IDs
+// of the local user running the mount, and back. All other IDs are passed
+// through, so remote files that already have the local user's IDs show up
+// as the local user's as well.
+func User(remoteUID, remoteGID uint32) Mapper {
+	localUID := uint32(os.Getuid())
+	localGID := uint32(os.Getgid())
+
+	return newTableMapper(
+		map[uint32]uint32{remoteUID: localUID},
+		map[uint32]uint32{remoteGID: localGID},
+	)
+}
+
+// FromFiles returns a Mapper backed by translation tables. Each line of the
+// files has the form "local:remote", where local is a local user (or group)
+// name or number and remote is the numeric ID on the server. Empty lines and
+// lines starting with '#' are ignored. Either file may be empty, in which
+// case the corresponding IDs are passed through.
+func FromFiles(uidFile, gidFile string) (Mapper, error) {
+	uids, err := readTable(uidFile, lookupUser)
+	if err != nil {
+		return nil, err
+	}
+
+	gids, err := readTable(gidFile, lookupGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	return newTableMapper(uids, gids), nil
+}
+
+// tableMapper maps remote IDs to local IDs. IDs missing from the tables are
+// passed through.
+type tableMapper struct {
+	localUIDs  map[uint32]uint32
+	localGIDs  map[uint32]uint32
+	remoteUIDs map[uint32]uint32
+	remoteGIDs map[uint32]uint32
+}
+
+func newTableMapper(uids, gids map[uint32]uint32) *tableMapper {
+	return &tableMapper{
+		localUIDs:  uids,
+		localGIDs:  gids,
+		remoteUIDs: invert(uids),
+		remoteGIDs: invert(gids),
+	}
+}
+
+func (tm *tableMapper) LocalUID(remote uint32) uint32 {
+	return lookUp(tm.localUIDs, remote)
+}
+
+func (tm *tableMapper) LocalGID(remote uint32) uint32 {
+	return lookUp(tm.localGIDs, remote)
+}
+
+func (tm *tableMapper) RemoteUID(local uint32) uint32 {
+	return lookUp(tm.remoteUIDs, local)
+}
+
+func (tm *tableMapper) RemoteGID(local uint32) uint32 {
+	return lookUp(tm.remoteGIDs, local)
+}
+
+func lookUp(table map[uint32]uint32, id uint32) uint32 {
+	if mapped, ok := table[id]; ok {
+		return mapped
+	}
+
+	return id
+}
+
+func invert(table map[uint32]uint32) map[uint32]uint32 {
+	inverted := make(map[uint32]uint32, len(table))
+	for k, v := range table {
+		inverted[v] = k
+	}
+
+	return inverted
+}
+
+// readTable parses a "local:remote" translation file into a map from remote
+// to local IDs.
+func readTable(file string, lookupLocal func(string) (uint32, error)) (map[uint32]uint32, error) {
+	table := make(map[uint32]uint32)
+	if file == "" {
+		return table, nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open id map '%s': %v", file, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		local, remote, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected 'local:remote'", file, lineNum)
+		}
+
+		localID, err := lookupLocal(strings.TrimSpace(local))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, lineNum, err)
+		}
+
+		remoteID, err := strconv.ParseUint(strings.TrimSpace(remote), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid remote id '%s'", file, lineNum, remote)
+		}
+
+		table[uint32(remoteID)] = localID
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read id map '%s': %v", file, err)
+	}
+
+	return table, nil
+}
+
+func lookupUser(name string) (uint32, error) {
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := strconv.ParseUint(u.Uid, 10, 32)
+	return uint32(id), err
+}
+
+func lookupGroup(name string) (uint32, error) {
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := strconv.ParseUint(g.Gid, 10, 32)
+	return uint32(id), err
+}
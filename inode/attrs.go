@@ -0,0 +1,67 @@
+package inode
+
+import (
+	"os"
+	"sftpfs/idmap"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/pkg/sftp"
+)
+
+// Attributes converts the remote file info into inode attributes. Owner IDs
+// are translated with ids.
+//
+// SFTP reports no change time, so the modification time stands in for it;
+// the inode can't have changed any earlier. The link count is 1, which tools
+// take to mean unknown for directories until they are listed. The extended
+// entries of the stat are vendor specific and have no counterpart here.
+func Attributes(info os.FileInfo, ids idmap.Mapper) fuseops.InodeAttributes {
+	attrs := fuseops.InodeAttributes{
+		Size:   uint64(info.Size()),
+		Nlink:  1,
+		Mode:   info.Mode(),
+		Atime:  info.ModTime(),
+		Mtime:  info.ModTime(),
+		Ctime:  info.ModTime(),
+		Crtime: info.ModTime(),
+	}
+
+	if stat, ok := info.Sys().(*sftp.FileStat); ok {
+		attrs.Atime = time.Unix(int64(stat.Atime), 0)
+		attrs.Uid = ids.LocalUID(stat.UID)
+		attrs.Gid = ids.LocalGID(stat.GID)
+	}
+
+	return attrs
+}
+
+// UpdateAttributes replaces the attributes of in with those of the remote
+// file info. The link count is kept, since SFTP doesn't report it and the
+// file system keeps track of it instead.
+func UpdateAttributes(in Inode, info os.FileInfo, ids idmap.Mapper) {
+	attrs := in.GetAttributes()
+	nlink := attrs.Nlink
+	*attrs = Attributes(info, ids)
+	attrs.Nlink = nlink
+
+	in.attributesFetched()
+}
+
+// fetchTime records when the attributes of an inode were fetched from the
+// server. Inodes are created from a fresh stat, so the clock starts then.
+type fetchTime struct {
+	fetched time.Time
+}
+
+func newFetchTime() fetchTime {
+	return fetchTime{fetched: time.Now()}
+}
+
+func (f *fetchTime) AttributesTime() time.Time {
+	return f.fetched
+}
+
+func (f *fetchTime) attributesFetched() {
+	f.fetched = time.Now()
+}
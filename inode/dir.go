@@ -5,17 +5,31 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"sort"
+	"time"
+
+	"sftpfs/idmap"
+	"sftpfs/remote"
 
 	"github.com/jacobsa/fuse/fuseops"
-	"github.com/pkg/sftp"
 )
 
 type DirInode interface {
 	Inode
-	LookUpChild(ctx context.Context, name string) Inode
-	GetEntries(ctx context.Context) ([]Inode, error)
+	LookUpChild(ctx context.Context, name string) (Inode, error)
+	GetEntries(ctx context.Context) ([]Entry, error)
 	AddEntry(name string, in Inode)
 	RemoveEntry(name string)
+	Invalidate()
+	Refresh() ([]Entry, error)
+	Clear()
+}
+
+// Entry is a name in a directory and the inode it refers to. Hard links share
+// an inode, so the name can't be derived from the inode.
+type Entry struct {
+	Name  string
+	Inode Inode
 }
 
 type dirInode struct {
@@ -24,15 +38,25 @@ type dirInode struct {
 	remotePath string
 	entries    map[string]Inode
 
-	sftpc    *sftp.Client
-	upToDate bool
+	conn *remote.Conn
+	ids  idmap.Mapper
+
+	// The entries are listed again once ttl has passed since listed, unless
+	// the remote directory still has the modification time it had then.
+	ttl         time.Duration
+	listed      time.Time
+	remoteMtime time.Time
+
+	fetchTime
 }
 
 func NewDir(
 	id fuseops.InodeID,
 	attrs *fuseops.InodeAttributes,
 	remotePath string,
-	sftpc *sftp.Client,
+	conn *remote.Conn,
+	ids idmap.Mapper,
+	ttl time.Duration,
 ) Inode {
 	dir := &dirInode{
 		id:         id,
@@ -40,8 +64,11 @@ func NewDir(
 		remotePath: remotePath,
 		entries:    make(map[string]Inode),
 
-		sftpc:    sftpc,
-		upToDate: false,
+		conn: conn,
+		ids:  ids,
+		ttl:  ttl,
+
+		fetchTime: newFetchTime(),
 	}
 
 	return dir
@@ -67,89 +94,202 @@ func (dir *dirInode) RemotePath() string {
 	return dir.remotePath
 }
 
+// SetRemotePath moves the directory and the known entries below it to s.
 func (dir *dirInode) SetRemotePath(s string) {
 	dir.remotePath = s
+
+	for name, in := range dir.entries {
+		in.SetRemotePath(path.Join(s, name))
+	}
 }
 
 func (dir *dirInode) AddEntry(name string, in Inode) {
 	dir.entries[name] = in
+	dir.updateNlink()
 }
 
 func (dir *dirInode) RemoveEntry(name string) {
 	delete(dir.entries, name)
+	dir.updateNlink()
+}
+
+// updateNlink sets the link count to 2 plus the number of subdirectories,
+// one for each "..", once the entries are known.
+func (dir *dirInode) updateNlink() {
+	if dir.listed.IsZero() {
+		return
+	}
+
+	nlink := uint32(2)
+	for _, in := range dir.entries {
+		if _, ok := in.(DirInode); ok {
+			nlink++
+		}
+	}
+
+	dir.attrs.Nlink = nlink
 }
 
-func (dir *dirInode) LookUpChild(ctx context.Context, name string) Inode {
+// Invalidate makes the next access list the remote directory again.
+func (dir *dirInode) Invalidate() {
+	dir.listed = time.Time{}
+}
+
+// Refresh lists the remote directory again right away and returns the entries
+// that were added, modified or removed. Removed entries have a nil inode.
+func (dir *dirInode) Refresh() ([]Entry, error) {
+	old := dir.entries
+	oldAttrs := make(map[string]fuseops.InodeAttributes, len(old))
+	for name, in := range old {
+		oldAttrs[name] = *in.GetAttributes()
+	}
+
+	dir.Invalidate()
 	if err := dir.populate(); err != nil {
-		// TODO handle this gracefully
-		panic(err)
+		return nil, err
+	}
+
+	var changed []Entry
+	for name, in := range dir.entries {
+		attrs, ok := oldAttrs[name]
+		if !ok || old[name] != in ||
+			!attrs.Mtime.Equal(in.GetAttributes().Mtime) || attrs.Size != in.GetAttributes().Size {
+			changed = append(changed, Entry{Name: name, Inode: in})
+		}
+	}
+	for name := range old {
+		if _, ok := dir.entries[name]; !ok {
+			changed = append(changed, Entry{Name: name})
+		}
 	}
 
-	return dir.entries[name] // TODO map this to not exists if no key present
+	return changed, nil
 }
 
-func (dir *dirInode) GetEntries(ctx context.Context) ([]Inode, error) {
+// Clear drops the entries and with them every inode known below the
+// directory. The next access lists the remote directory again.
+func (dir *dirInode) Clear() {
+	dir.entries = make(map[string]Inode)
+	dir.listed = time.Time{}
+}
+
+// LookUpChild returns the entry called name, or nil if there is none.
+func (dir *dirInode) LookUpChild(ctx context.Context, name string) (Inode, error) {
 	if err := dir.populate(); err != nil {
 		return nil, err
 	}
 
-	all := make([]Inode, len(dir.entries))
+	return dir.entries[name], nil
+}
+
+// GetEntries returns the entries sorted by name, so that the offsets handed
+// out by ReadDir stay valid between calls.
+func (dir *dirInode) GetEntries(ctx context.Context) ([]Entry, error) {
+	if err := dir.populate(); err != nil {
+		return nil, err
+	}
 
-	i := 0
-	for _, inode := range dir.entries {
-		all[i] = inode
-		i++
+	all := make([]Entry, 0, len(dir.entries))
+	for name, in := range dir.entries {
+		all = append(all, Entry{Name: name, Inode: in})
 	}
 
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+
 	return all, nil
 }
 
+// populate brings the entries up to date with the remote directory. Entries
+// that are still there keep their inodes, so that their IDs stay the same.
 func (dir *dirInode) populate() (err error) {
-	if dir.upToDate {
+	if !dir.listed.IsZero() && time.Since(dir.listed) < dir.ttl {
 		return nil
 	}
 
-	newInodes := make(map[string]Inode)
 	defer func() {
 		if err != nil {
-			err = fmt.Errorf("failed to populate '%s': %v", dir.remotePath, err)
-			return
-		}
-
-		dir.upToDate = true
-		for k, v := range newInodes {
-			dir.AddEntry(k, v)
+			err = fmt.Errorf("failed to populate '%s': %w", dir.remotePath, err)
 		}
 	}()
 
-	entries, err := dir.sftpc.ReadDir(dir.remotePath)
+	client, err := dir.conn.Client()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	info, err := client.Stat(dir.remotePath)
+	if err != nil {
+		return fmt.Errorf("failed to stat remote dir '%s': %w", dir.remotePath, err)
+	}
+
+	// SFTP times have a resolution of one second, so the modification time
+	// only proves that nothing changed if it is from before the second the
+	// entries were listed in.
+	if !dir.listed.IsZero() &&
+		info.ModTime().Equal(dir.remoteMtime) &&
+		dir.remoteMtime.Before(dir.listed.Truncate(time.Second)) {
+		dir.listed = now
+		return nil
+	}
+
+	entries, err := client.ReadDir(dir.remotePath)
 	if err != nil {
-		return fmt.Errorf("failed to list remote dir '%s': %v", dir.remotePath, err)
+		return fmt.Errorf("failed to list remote dir '%s': %w", dir.remotePath, err)
 	}
 
+	merged := make(map[string]Inode, len(entries))
 	for _, entry := range entries {
-		in := dir.inodeFromRemoteDentry(entry)
-		newInodes[in.Name()] = in
+		if IsHidden(entry.Name()) {
+			continue
+		}
+
+		name := entry.Name()
+		if in, ok := dir.entries[name]; ok && sameType(in, entry) {
+			UpdateAttributes(in, entry, dir.ids)
+
+			if link, ok := in.(SymlinkInode); ok {
+				link.Invalidate()
+			}
+
+			merged[name] = in
+			continue
+		}
+
+		merged[name] = dir.inodeFromRemoteDentry(entry)
 	}
 
+	dir.entries = merged
+	dir.listed = now
+	dir.remoteMtime = info.ModTime()
+	dir.updateNlink()
+
 	return nil
 }
 
-func (dir *dirInode) inodeFromRemoteDentry(entry os.FileInfo) Inode {
-	attrs := fuseops.InodeAttributes{
-		Size:  uint64(entry.Size()),
-		Nlink: 1,
-		Mode:  entry.Mode(),
-		Mtime: entry.ModTime(),
-
-		Uid: uint32(os.Geteuid()),
-		Gid: uint32(os.Getegid()),
+// sameType reports whether in can stand for the remote entry.
+func sameType(in Inode, entry os.FileInfo) bool {
+	switch in.(type) {
+	case DirInode:
+		return entry.IsDir()
+	case SymlinkInode:
+		return entry.Mode()&os.ModeSymlink != 0
+	default:
+		return entry.Mode().IsRegular()
 	}
+}
+
+func (dir *dirInode) inodeFromRemoteDentry(entry os.FileInfo) Inode {
+	attrs := Attributes(entry, dir.ids)
 
 	remotePath := path.Join(dir.remotePath, entry.Name())
 
 	if entry.IsDir() {
-		return NewDir(0, &attrs, remotePath, dir.sftpc)
+		return NewDir(0, &attrs, remotePath, dir.conn, dir.ids, dir.ttl)
+	}
+
+	if entry.Mode()&os.ModeSymlink != 0 {
+		return NewSymlink(0, &attrs, remotePath, "", dir.conn)
 	}
 
 	return NewFile(0, &attrs, remotePath)
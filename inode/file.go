@@ -21,6 +21,8 @@ type fileInode struct {
 	remotePath string
 
 	content []byte
+
+	fetchTime
 }
 
 func NewFile(id fuseops.InodeID, attrs *fuseops.InodeAttributes, remotePath string) Inode {
@@ -28,6 +30,7 @@ func NewFile(id fuseops.InodeID, attrs *fuseops.InodeAttributes, remotePath stri
 		id:         id,
 		attrs:      attrs,
 		remotePath: remotePath,
+		fetchTime:  newFetchTime(),
 	}
 }
 
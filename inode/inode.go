@@ -1,9 +1,21 @@
 package inode
 
 import (
+	"strings"
+	"time"
+
 	"github.com/jacobsa/fuse/fuseops"
 )
 
+// HiddenPrefix starts the names of the files sftpfs keeps on the server for
+// its own bookkeeping. They never show up in the mount.
+const HiddenPrefix = ".sftpfs-"
+
+// IsHidden reports whether name is reserved for sftpfs' own files.
+func IsHidden(name string) bool {
+	return strings.HasPrefix(name, HiddenPrefix)
+}
+
 type Inode interface {
 	InodeID() fuseops.InodeID
 	SetInodeID(fuseops.InodeID)
@@ -11,4 +23,9 @@ type Inode interface {
 	RemotePath() string
 	SetRemotePath(string)
 	GetAttributes() *fuseops.InodeAttributes
+
+	// AttributesTime is when the attributes were last fetched from the
+	// server.
+	AttributesTime() time.Time
+	attributesFetched()
 }
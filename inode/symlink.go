@@ -0,0 +1,97 @@
+package inode
+
+import (
+	"fmt"
+	"path"
+	"sftpfs/remote"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+type SymlinkInode interface {
+	Inode
+	Target() (string, error)
+	Invalidate()
+}
+
+type symlinkInode struct {
+	id         fuseops.InodeID
+	attrs      *fuseops.InodeAttributes
+	remotePath string
+
+	// target is read from the server the first time it is needed, unless
+	// the link was created through the mount.
+	target string
+	conn   *remote.Conn
+
+	fetchTime
+}
+
+func NewSymlink(
+	id fuseops.InodeID,
+	attrs *fuseops.InodeAttributes,
+	remotePath string,
+	target string,
+	conn *remote.Conn,
+) Inode {
+	return &symlinkInode{
+		id:         id,
+		attrs:      attrs,
+		remotePath: remotePath,
+		target:     target,
+		conn:       conn,
+		fetchTime:  newFetchTime(),
+	}
+}
+
+func (s *symlinkInode) InodeID() fuseops.InodeID {
+	return s.id
+}
+
+func (s *symlinkInode) SetInodeID(id fuseops.InodeID) {
+	s.id = id
+}
+
+func (s *symlinkInode) GetAttributes() *fuseops.InodeAttributes {
+	return s.attrs
+}
+
+func (s *symlinkInode) Name() string {
+	return path.Base(s.remotePath)
+}
+
+func (s *symlinkInode) RemotePath() string {
+	return s.remotePath
+}
+
+func (s *symlinkInode) SetRemotePath(p string) {
+	s.remotePath = p
+}
+
+// Invalidate makes the next Target read the link from the server again, for
+// when it may have been replaced there.
+func (s *symlinkInode) Invalidate() {
+	s.target = ""
+}
+
+// Target returns the path the link points to, exactly as stored on the
+// server.
+func (s *symlinkInode) Target() (string, error) {
+	if s.target != "" {
+		return s.target, nil
+	}
+
+	client, err := s.conn.Client()
+	if err != nil {
+		return "", err
+	}
+
+	target, err := client.ReadLink(s.remotePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read remote link '%s': %w", s.remotePath, err)
+	}
+
+	s.target = target
+
+	return target, nil
+}
@@ -7,13 +7,16 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"os/user"
 	"sftpfs/filesystem"
+	"sftpfs/notify"
+	"sftpfs/remote"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseutil"
-	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/term"
 )
@@ -21,36 +24,188 @@ import (
 const envPassword = "SFTPFS_PASSWORD"
 const envUsername = "SFTPFS_USERNAME"
 
+const defaultPort = 22
+
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [user@]host[:path] [mountpoint]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
 	flagMountpoint := flag.String("m", "/tmp/mnt", "Directory where the fs should be mounted.")
 	flagUsername := flag.String("u", "", "Username.")
 	flagPasswordPrompt := flag.Bool("p", false, "Password prompt.")
-	flagServerHost := flag.String("server", "alas.math.rs", "Host of the remote SSH server.")
-	flagServerPort := flag.Int("port", 22, "Port of the remote SSH server.")
+	flagServerHost := flag.String("server", "", "Host of the remote SSH server, if not given as an argument.")
+	flagServerPort := flag.Int("port", defaultPort, "Port of the remote SSH server.")
+	var flagIdentityFiles stringList
+	flag.Var(&flagIdentityFiles, "i", "Private key used for public key authentication; may be repeated.")
+	flagKnownHosts := flag.String("known-hosts", "", "known_hosts file used to verify the server host key (default: UserKnownHostsFile or ~/.ssh/known_hosts).")
+	flagJumpHosts := flag.String("J", "", "Comma separated jump hosts ([user@]host[:port]) to connect through.")
+	flagServerAliveInterval := flag.Duration("server-alive-interval", 15*time.Second, "Interval between keepalives sent to the server; 0 disables them (default: ServerAliveInterval or 15s).")
+	flagServerAliveCountMax := flag.Int("server-alive-count-max", 3, "Unanswered keepalives after which the connection is considered dead (default: ServerAliveCountMax or 3).")
+	flagReconnectGrace := flag.Duration("reconnect-grace", 30*time.Second, "How long operations wait for a lost connection to come back before failing.")
+	flagRemotePath := flag.String("remote-path", "", "Remote directory to mount; relative paths start at the login directory (default: login directory).")
+	flagDirCacheTTL := flag.Duration("dir-cache-ttl", 5*time.Second, "How long directory listings are cached before the server is asked for changes.")
+	flagPollInterval := flag.Duration("poll-interval", 5*time.Second, "How often directories in use and open files are checked for changes on the server; 0 disables polling.")
+	flagOptions := make(mountOptions)
+	flag.Var(flagOptions, "o", "Comma separated mount options: idmap=none|user|file (default user), uidfile=FILE, gidfile=FILE, transform_symlinks, statfs_fallback=SIZE (0 to fail), strict_sync, xattr=none|sidecar, attr_timeout=SECONDS, entry_timeout=SECONDS, negative_timeout=SECONDS.")
+	flagSSHConfig := flag.String("F", "", "ssh_config file (default: ~/.ssh/config and /etc/ssh/ssh_config).")
 	flag.Parse()
 
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+
+	hostSpec, remotePath := splitRemotePath(flag.Arg(0))
+	if setFlags["remote-path"] {
+		remotePath = *flagRemotePath
+	}
+
+	targetUser, alias := parseTarget(hostSpec)
+	alias = strings.Trim(alias, "[]")
+	if alias == "" {
+		alias = *flagServerHost
+	}
+	if alias == "" {
+		fmt.Fprintln(flag.CommandLine.Output(), "no host given")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	mountpoint := *flagMountpoint
+	if flag.NArg() > 1 {
+		mountpoint = flag.Arg(1)
+	}
+
+	sshCfg, err := loadSSHConfig(*flagSSHConfig)
+	if err != nil {
+		log.Fatalf("failed to load ssh config: %v", err)
+	}
+
 	password, err := getPassword(*flagPasswordPrompt, os.Getenv(envPassword))
 	if err != nil {
 		log.Fatalf("failed to read password: %v", err)
 	}
 
-	username, err := getUsername(*flagUsername, os.Getenv(envUsername))
+	hosts := &connector{
+		sshCfg:        sshCfg,
+		identities:    newIdentities(),
+		identityFiles: flagIdentityFiles,
+		knownHosts:    *flagKnownHosts,
+		password:      password,
+	}
+
+	port := 0
+	if setFlags["port"] {
+		port = *flagServerPort
+	}
+
+	target, err := hosts.endpoint(alias, port, targetUser, *flagUsername, os.Getenv(envUsername))
 	if err != nil {
-		log.Fatalf("failed to read username: %v", err)
+		log.Fatalf("failed to set up connection: %v", err)
 	}
 
-	sftpClient, err := setUpSftp(username, password, *flagServerHost, *flagServerPort)
+	jumpSpec := target.proxyJump
+	if setFlags["J"] {
+		jumpSpec = *flagJumpHosts
+	}
+
+	hops, err := hosts.jumpHosts(jumpSpec)
+	if err != nil {
+		log.Fatalf("failed to set up jump hosts: %v", err)
+	}
+
+	connOpts := remote.Options{
+		ReconnectGrace:    *flagReconnectGrace,
+		KeepAliveInterval: *flagServerAliveInterval,
+		KeepAliveCountMax: *flagServerAliveCountMax,
+	}
+	if !setFlags["server-alive-interval"] && target.serverAliveInterval > 0 {
+		connOpts.KeepAliveInterval = target.serverAliveInterval
+	}
+	if !setFlags["server-alive-count-max"] && target.serverAliveCountMax > 0 {
+		connOpts.KeepAliveCountMax = target.serverAliveCountMax
+	}
+
+	hops = append(hops, target)
+	conn, err := remote.New(func(interactive bool) (*ssh.Client, error) {
+		return hosts.dial(hops, interactive)
+	}, connOpts)
 	if err != nil {
 		log.Fatalf("failed to setup SFTP client: %v", err)
 	}
+	defer conn.Close()
+
+	ids, err := idMapper(flagOptions, conn, remotePath)
+	if err != nil {
+		log.Fatalf("failed to set up id mapping: %v", err)
+	}
+
+	xattrs, err := xattrStore(flagOptions, conn)
+	if err != nil {
+		log.Fatalf("failed to set up extended attributes: %v", err)
+	}
+
+	attrTimeout, err := timeout(flagOptions, "attr_timeout", 5*time.Second)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
 
-	srv := fuseutil.NewFileSystemServer(filesystem.New(sftpClient))
+	entryTimeout, err := timeout(flagOptions, "entry_timeout", 5*time.Second)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	negativeTimeout, err := timeout(flagOptions, "negative_timeout", 5*time.Second)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	_, transformSymlinks := flagOptions["transform_symlinks"]
+	_, strictSync := flagOptions["strict_sync"]
+
+	fallback, err := statFSFallback(flagOptions)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	notifier := notify.NewDevice()
+
+	fsCfg := filesystem.Config{
+		RemotePath:        remotePath,
+		DirCacheTTL:       *flagDirCacheTTL,
+		PollInterval:      *flagPollInterval,
+		AttrTimeout:       attrTimeout,
+		EntryTimeout:      entryTimeout,
+		NegativeTimeout:   negativeTimeout,
+		IDMap:             ids,
+		Xattrs:            xattrs,
+		TransformSymlinks: transformSymlinks,
+		StatFSFallback:    fallback,
+		StrictSync:        strictSync,
+		Notifier:          notifier,
+	}
+
+	fs, err := filesystem.New(conn, fsCfg)
+	if err != nil {
+		log.Fatalf("failed to set up file system: %v", err)
+	}
+
+	srv := fuseutil.NewFileSystemServer(fs)
+
+	mountCfg := &fuse.MountConfig{
+		FSName:  fmt.Sprintf("%s@%s:%s", target.user, alias, remotePath),
+		Subtype: "sftpfs",
+	}
 
-	mfs, err := fuse.Mount(*flagMountpoint, srv, &fuse.MountConfig{})
+	mfs, err := fuse.Mount(mountpoint, srv, mountCfg)
 	if err != nil {
 		log.Fatalf("mount failed: %v", err)
 	}
 
+	if err := notifier.Attach(); err != nil {
+		log.Printf("remote changes won't invalidate the kernel cache: %v", err)
+	}
+
 	sigs := make(chan os.Signal, 1)
 
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
@@ -68,56 +223,81 @@ func main() {
 	}
 }
 
-func setUpSftp(username, password, host string, port int) (*sftp.Client, error) {
-	config := &ssh.ClientConfig{
-		User: username,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(password),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+// splitRemotePath splits a "[user@]host[:path]" command line argument into
+// the host part and the remote path. IPv6 addresses have to be enclosed in
+// square brackets.
+func splitRemotePath(arg string) (hostSpec, remotePath string) {
+	start := 0
+	if i := strings.Index(arg, "["); i >= 0 {
+		if j := strings.Index(arg[i:], "]"); j >= 0 {
+			start = i + j
+		}
 	}
 
-	addr := fmt.Sprintf("%s:%d", host, port)
-	client, err := ssh.Dial("tcp", addr, config)
-	if err != nil {
-		return nil, fmt.Errorf("failed to dial %v: %v", addr, err)
+	if i := strings.Index(arg[start:], ":"); i >= 0 {
+		return arg[:start+i], arg[start+i+1:]
 	}
 
-	sftpClient, err := sftp.NewClient(client)
-	if err != nil {
-		return nil, err
+	return arg, ""
+}
+
+// parseTarget splits a "[user@]host" command line argument.
+func parseTarget(arg string) (username, host string) {
+	if i := strings.LastIndex(arg, "@"); i >= 0 {
+		return arg[:i], arg[i+1:]
 	}
 
-	return sftpClient, nil
+	return "", arg
 }
 
-func getUsername(fromFlag string, def string) (string, error) {
-	if len(fromFlag) > 0 {
-		return fromFlag, nil
+// getUsername returns the first non-empty candidate, falling back to the
+// local user name like ssh does.
+func getUsername(candidates ...string) (string, error) {
+	for _, candidate := range candidates {
+		if len(candidate) > 0 {
+			return candidate, nil
+		}
 	}
 
-	if len(def) == 0 {
-		return "", fmt.Errorf("default username is empty")
+	u, err := user.Current()
+	if err != nil {
+		return "", fmt.Errorf("no username given and local user is unknown: %v", err)
 	}
 
-	return def, nil
+	return u.Username, nil
 }
 
+// getPassword returns the password to offer to the server. An empty password
+// means that password authentication is skipped.
 func getPassword(prompt bool, def string) (string, error) {
 	if !prompt {
-		if def == "" {
-			return "", fmt.Errorf("default password is empty")
-		}
-
 		return def, nil
 	}
 
-	fmt.Print("Enter Password: ")
-	bytePassword, err := term.ReadPassword(int(syscall.Stdin))
+	return readSecret("Enter Password: ")
+}
+
+// readSecret prints the prompt and reads a line from the terminal without
+// echoing it.
+func readSecret(prompt string) (string, error) {
+	fmt.Print(prompt)
+	byteSecret, err := term.ReadPassword(int(syscall.Stdin))
+	fmt.Println()
 	if err != nil {
 		return "", err
 	}
 
-	password := string(bytePassword)
-	return strings.TrimSpace(password), nil
+	return strings.TrimSpace(string(byteSecret)), nil
+}
+
+// stringList is a flag.Value that collects every occurrence of a flag.
+type stringList []string
+
+func (sl *stringList) String() string {
+	return strings.Join(*sl, ",")
+}
+
+func (sl *stringList) Set(s string) error {
+	*sl = append(*sl, s)
+	return nil
 }
@@ -0,0 +1,160 @@
+// Package notify sends invalidation notices to the kernel, which the fuse
+// package has no API for. The notices are written to the FUSE device of the
+// mount, like libfuse's fuse_lowlevel_notify_inval_inode and
+// fuse_lowlevel_notify_inval_entry do.
+package notify
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+const fuseDevice = "/dev/fuse"
+
+// Notification codes from linux/fuse.h.
+const (
+	notifyInvalInode = 2
+	notifyInvalEntry = 3
+)
+
+// outHeader is struct fuse_out_header. Notifications have no unique ID and
+// carry their code in the error field.
+type outHeader struct {
+	len    uint32
+	error  int32
+	unique uint64
+}
+
+// invalInodeOut is struct fuse_notify_inval_inode_out.
+type invalInodeOut struct {
+	ino uint64
+	off int64
+	len int64
+}
+
+// invalEntryOut is struct fuse_notify_inval_entry_out, followed by the name
+// and a NUL byte.
+type invalEntryOut struct {
+	parent  uint64
+	namelen uint32
+	padding uint32
+}
+
+// Device writes notices to the FUSE device of a mount. Until Attach found the
+// device, notices are dropped.
+type Device struct {
+	mu sync.Mutex
+	fd int
+}
+
+func NewDevice() *Device {
+	return &Device{fd: -1}
+}
+
+// Attach finds the FUSE device among the open files of the process. It must
+// be called once the file system is mounted. The fuse package may leave an
+// unmounted device open when it falls back to fusermount(1), so each
+// candidate is tried with a notice for the root inode, which only a mounted
+// device accepts.
+func (d *Device) Attach() error {
+	const fdDir = "/proc/self/fd"
+
+	names, err := os.ReadDir(fdDir)
+	if err != nil {
+		return fmt.Errorf("failed to list open files: %v", err)
+	}
+
+	for _, name := range names {
+		fd, err := strconv.Atoi(name.Name())
+		if err != nil {
+			continue
+		}
+
+		target, err := os.Readlink(filepath.Join(fdDir, name.Name()))
+		if err != nil || target != fuseDevice {
+			continue
+		}
+
+		if err := write(fd, invalInode(fuseops.RootInodeID, -1)); err != nil {
+			continue
+		}
+
+		d.mu.Lock()
+		d.fd = fd
+		d.mu.Unlock()
+
+		return nil
+	}
+
+	return fmt.Errorf("no mounted %s among the open files", fuseDevice)
+}
+
+// InvalidateInode makes the kernel drop the attributes and the cached data of
+// the inode.
+func (d *Device) InvalidateInode(id fuseops.InodeID) error {
+	return d.send(invalInode(id, 0))
+}
+
+// InvalidateEntry makes the kernel drop what name in the directory parent
+// resolves to, including the knowledge that it doesn't exist.
+func (d *Device) InvalidateEntry(parent fuseops.InodeID, name string) error {
+	out := invalEntryOut{parent: uint64(parent), namelen: uint32(len(name))}
+
+	msg := append(bytesOf(&out), name...)
+	return d.send(notice(notifyInvalEntry, append(msg, 0)))
+}
+
+// send writes msg to the device. The kernel answers ENOENT for what it has
+// no cache of, which is not an error here.
+func (d *Device) send(msg []byte) error {
+	d.mu.Lock()
+	fd := d.fd
+	d.mu.Unlock()
+
+	if fd < 0 {
+		return nil
+	}
+
+	err := write(fd, msg)
+	if errors.Is(err, syscall.ENOENT) {
+		return nil
+	}
+
+	return err
+}
+
+// invalInode builds the notice for the inode. A negative offset leaves the
+// cached data alone, zero drops all of it.
+func invalInode(id fuseops.InodeID, off int64) []byte {
+	out := invalInodeOut{ino: uint64(id), off: off}
+	return notice(notifyInvalInode, bytesOf(&out))
+}
+
+func notice(code int32, body []byte) []byte {
+	header := outHeader{
+		len:   uint32(unsafe.Sizeof(outHeader{})) + uint32(len(body)),
+		error: code,
+	}
+
+	return append(bytesOf(&header), body...)
+}
+
+// bytesOf returns a copy of the memory of *v, which is laid out like the
+// kernel expects.
+func bytesOf[T any](v *T) []byte {
+	b := unsafe.Slice((*byte)(unsafe.Pointer(v)), unsafe.Sizeof(*v))
+	return append([]byte(nil), b...)
+}
+
+func write(fd int, msg []byte) error {
+	_, err := syscall.Write(fd, msg)
+	return err
+}
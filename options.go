@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path"
+	"sftpfs/idmap"
+	"sftpfs/inode"
+	"sftpfs/remote"
+	"sftpfs/xattr"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// knownOptions lists the keys accepted by -o.
+var knownOptions = map[string]bool{
+	"idmap":   true,
+	"uidfile": true,
+	"gidfile": true,
+
+	"transform_symlinks": true,
+	"statfs_fallback":    true,
+	"strict_sync":        true,
+	"xattr":              true,
+	"attr_timeout":       true,
+	"entry_timeout":      true,
+	"negative_timeout":   true,
+}
+
+// defaultStatFSFallback is the free space reported by servers that can't
+// tell, large enough that programs don't refuse to copy files in.
+const defaultStatFSFallback = 1 << 50
+
+// mountOptions collects the comma separated "key[=value]" options given with
+// -o, in the style of sshfs.
+type mountOptions map[string]string
+
+func (mo mountOptions) String() string {
+	var opts []string
+	for k, v := range mo {
+		if v == "" {
+			opts = append(opts, k)
+			continue
+		}
+		opts = append(opts, k+"="+v)
+	}
+	sort.Strings(opts)
+
+	return strings.Join(opts, ",")
+}
+
+func (mo mountOptions) Set(s string) error {
+	for _, opt := range strings.Split(s, ",") {
+		if opt == "" {
+			continue
+		}
+
+		key, value, _ := strings.Cut(opt, "=")
+		if !knownOptions[key] {
+			return fmt.Errorf("unknown option '%s'", key)
+		}
+
+		mo[key] = value
+	}
+
+	return nil
+}
+
+// idMapper builds the uid/gid translation selected with the idmap option.
+// The kernel checks permissions against the mapped owners, so the default is
+// user: without it the login user's own files would belong to a stranger
+// whenever the remote and local IDs differ.
+func idMapper(opts mountOptions, conn *remote.Conn, remotePath string) (idmap.Mapper, error) {
+	switch opts["idmap"] {
+	case "none":
+		return idmap.None(), nil
+	case "", "user":
+		uid, gid, err := loginIDs(conn, remotePath)
+		if err != nil {
+			log.Printf("%v; passing IDs through unchanged, use idmap=file to map them", err)
+			return idmap.None(), nil
+		}
+
+		return idmap.User(uid, gid), nil
+	case "file":
+		if opts["uidfile"] == "" && opts["gidfile"] == "" {
+			return nil, fmt.Errorf("idmap=file needs uidfile or gidfile")
+		}
+
+		return idmap.FromFiles(opts["uidfile"], opts["gidfile"])
+	default:
+		return nil, fmt.Errorf("unknown idmap '%s': expected none, user or file", opts["idmap"])
+	}
+}
+
+// xattrStore builds the extended attribute store selected with the xattr
+// option.
+func xattrStore(opts mountOptions, conn *remote.Conn) (xattr.Store, error) {
+	switch opts["xattr"] {
+	case "", "none":
+		return xattr.None(), nil
+	case "sidecar":
+		return xattr.Sidecar(conn), nil
+	default:
+		return nil, fmt.Errorf("unknown xattr '%s': expected none or sidecar", opts["xattr"])
+	}
+}
+
+// timeout returns the duration given in seconds with the option key, or def
+// if the option isn't set.
+func timeout(opts mountOptions, key string, def time.Duration) (time.Duration, error) {
+	value, ok := opts[key]
+	if !ok {
+		return def, nil
+	}
+
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("invalid %s '%s': expected seconds", key, value)
+	}
+
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// statFSFallback returns the size given with the statfs_fallback option.
+func statFSFallback(opts mountOptions) (uint64, error) {
+	value, ok := opts["statfs_fallback"]
+	if !ok {
+		return defaultStatFSFallback, nil
+	}
+
+	size, err := parseSize(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid statfs_fallback '%s': %v", value, err)
+	}
+
+	return size, nil
+}
+
+// parseSize parses a byte count with an optional K, M, G, T or P suffix,
+// each a power of 1024.
+func parseSize(s string) (uint64, error) {
+	shift := 0
+	if i := strings.IndexAny(s, "KMGTP"); i >= 0 && i == len(s)-1 {
+		shift = 10 * (strings.Index("KMGTP", s[i:]) + 1)
+		s = s[:i]
+	}
+
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	if n > math.MaxUint64>>shift {
+		return 0, fmt.Errorf("size out of range")
+	}
+
+	return n << shift, nil
+}
+
+// loginIDs returns the IDs of the remote login user. Like sshfs, they are
+// taken from the owner of the login directory. That may belong to root, e.g.
+// under ChrootDirectory, in which case the user creates a file to find out,
+// in the mounted directory first.
+func loginIDs(conn *remote.Conn, remotePath string) (uint32, uint32, error) {
+	client, err := conn.Client()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	wd, err := client.Getwd()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get remote working directory: %v", err)
+	}
+
+	if info, err := client.Stat(wd); err == nil {
+		if stat, ok := info.Sys().(*sftp.FileStat); ok && stat.UID != 0 {
+			return stat.UID, stat.GID, nil
+		}
+	}
+
+	root := remotePath
+	if !path.IsAbs(root) {
+		root = path.Join(wd, root)
+	}
+
+	name := fmt.Sprintf("%sids-%d", inode.HiddenPrefix, time.Now().UnixNano())
+
+	var errs []string
+	for _, dir := range []string{root, wd, "/tmp"} {
+		uid, gid, err := createdIDs(client, path.Join(dir, name))
+		if err == nil {
+			return uid, gid, nil
+		}
+
+		errs = append(errs, err.Error())
+	}
+
+	return 0, 0, fmt.Errorf(
+		"failed to find out the remote user's IDs: %s",
+		strings.Join(errs, "; "),
+	)
+}
+
+// createdIDs creates an empty file at remotePath and returns its owner.
+func createdIDs(client *sftp.Client, remotePath string) (uint32, uint32, error) {
+	f, err := client.OpenFile(remotePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to create '%s': %v", remotePath, err)
+	}
+	defer client.Remove(remotePath)
+
+	info, err := f.Stat()
+	f.Close()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to stat '%s': %v", remotePath, err)
+	}
+
+	stat, ok := info.Sys().(*sftp.FileStat)
+	if !ok {
+		return 0, 0, fmt.Errorf("server did not report the owner of '%s'", remotePath)
+	}
+
+	return stat.UID, stat.GID, nil
+}
@@ -0,0 +1,314 @@
+package remote
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrDisconnected is returned when the server stayed unreachable for longer
+// than the grace period.
+var ErrDisconnected = errors.New("disconnected from the SFTP server")
+
+const (
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+// keepAliveRequest is the global request OpenSSH itself uses to probe the
+// server. Servers that don't know it still reply, which is all we need.
+const keepAliveRequest = "keepalive@openssh.com"
+
+// Dialer opens a new, authenticated SSH connection to the server. interactive
+// is false for reconnects in the background, which must not prompt on the
+// terminal since nobody is there to answer.
+type Dialer func(interactive bool) (*ssh.Client, error)
+
+// Options configure the supervision of the connection.
+type Options struct {
+	// ReconnectGrace is how long callers wait for a lost connection to come
+	// back before failing with ErrDisconnected.
+	ReconnectGrace time.Duration
+
+	// KeepAliveInterval is the interval between keepalive requests, like
+	// ServerAliveInterval in ssh_config. Zero disables keepalives.
+	KeepAliveInterval time.Duration
+
+	// KeepAliveCountMax is the number of unanswered keepalives after which
+	// the connection is considered dead, like ServerAliveCountMax.
+	KeepAliveCountMax int
+}
+
+// Conn supervises the SFTP session. When the SSH connection goes away it is
+// re-established in the background with exponential backoff, while callers of
+// Client wait for up to the grace period for it to come back.
+type Conn struct {
+	dial Dialer
+	opts Options
+
+	mu         sync.Mutex
+	sshClient  *ssh.Client
+	client     *sftp.Client
+	generation uint64
+	closed     bool
+
+	// unreachable is set once the server is known to be gone, because it
+	// stopped answering keepalives or didn't come back within the grace
+	// period. Callers then fail right away instead of waiting, until the
+	// next reconnect.
+	unreachable bool
+
+	// ready is closed while a session is available and replaced with a new
+	// channel as soon as it is lost.
+	ready chan struct{}
+}
+
+// New dials the server once and starts supervising the connection. The
+// initial connection is not retried, so that bad credentials fail fast.
+func New(dial Dialer, opts Options) (*Conn, error) {
+	c := &Conn{
+		dial:  dial,
+		opts:  opts,
+		ready: make(chan struct{}),
+	}
+
+	sshClient, client, err := c.connect(true)
+	if err != nil {
+		return nil, err
+	}
+
+	c.setSession(sshClient, client)
+
+	return c, nil
+}
+
+// Client returns the current SFTP client. If the connection is down it waits
+// for up to the grace period for a reconnect and returns ErrDisconnected if
+// none happens. While the server is known to be unreachable, ErrDisconnected
+// is returned without waiting.
+func (c *Conn) Client() (*sftp.Client, error) {
+	client, _, err := c.Session()
+	return client, err
+}
+
+// Session is like Client, but also returns the generation of the session.
+// The generation changes on every reconnect, which tells holders of remote
+// file handles that they have to open their files again.
+func (c *Conn) Session() (*sftp.Client, uint64, error) {
+	c.mu.Lock()
+	ready := c.ready
+	unreachable := c.unreachable
+	c.mu.Unlock()
+
+	select {
+	case <-ready:
+	default:
+		if unreachable {
+			return nil, 0, ErrDisconnected
+		}
+
+		timer := time.NewTimer(c.opts.ReconnectGrace)
+		defer timer.Stop()
+
+		select {
+		case <-ready:
+		case <-timer.C:
+			c.setUnreachable(ready)
+			return nil, 0, ErrDisconnected
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client == nil {
+		return nil, 0, ErrDisconnected
+	}
+
+	return c.client, c.generation, nil
+}
+
+// Close tears down the session and stops reconnecting.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	if c.sshClient == nil {
+		return nil
+	}
+
+	c.client.Close()
+	return c.sshClient.Close()
+}
+
+func (c *Conn) connect(interactive bool) (*ssh.Client, *sftp.Client, error) {
+	sshClient, err := c.dial(interactive)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, nil, err
+	}
+
+	return sshClient, client, nil
+}
+
+func (c *Conn) setSession(sshClient *ssh.Client, client *sftp.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		client.Close()
+		sshClient.Close()
+		return
+	}
+
+	c.sshClient = sshClient
+	c.client = client
+	c.generation++
+	c.unreachable = false
+	close(c.ready)
+
+	go c.supervise(sshClient, client)
+	go c.keepAlive(sshClient)
+}
+
+// setUnreachable marks the server as unreachable, unless a reconnect
+// happened since ready was current.
+func (c *Conn) setUnreachable(ready chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ready == ready {
+		c.unreachable = true
+	}
+}
+
+// supervise waits for the session to end and reconnects unless the
+// connection was closed on purpose.
+func (c *Conn) supervise(sshClient *ssh.Client, client *sftp.Client) {
+	done := make(chan error, 2)
+	go func() { done <- sshClient.Wait() }()
+	go func() { done <- client.Wait() }()
+	err := <-done
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+
+	log.Printf("lost connection to the SFTP server: %v", err)
+	c.sshClient = nil
+	c.client = nil
+	c.ready = make(chan struct{})
+	c.mu.Unlock()
+
+	client.Close()
+	sshClient.Close()
+
+	c.reconnect()
+}
+
+func (c *Conn) reconnect() {
+	backoff := minBackoff
+	for {
+		c.mu.Lock()
+		closed := c.closed
+		c.mu.Unlock()
+		if closed {
+			return
+		}
+
+		sshClient, client, err := c.connect(false)
+		if err == nil {
+			log.Printf("reconnected to the SFTP server")
+			c.setSession(sshClient, client)
+			return
+		}
+
+		log.Printf("failed to reconnect, retrying in %v: %v", backoff, err)
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// keepAlive probes the server every KeepAliveInterval. A half-open TCP
+// connection would otherwise hang operations until the kernel gives up on it,
+// so the connection is closed once KeepAliveCountMax probes in a row went
+// unanswered. Closing it fails the pending operations right away and lets
+// supervise reconnect, and until then new operations fail right away too.
+func (c *Conn) keepAlive(sshClient *ssh.Client) {
+	if c.opts.KeepAliveInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(c.opts.KeepAliveInterval)
+	defer ticker.Stop()
+
+	closed := make(chan struct{})
+	go func() {
+		sshClient.Wait()
+		close(closed)
+	}()
+
+	missed := 0
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+		}
+
+		if c.probe(sshClient) {
+			missed = 0
+			continue
+		}
+
+		missed++
+		if missed >= c.opts.KeepAliveCountMax {
+			log.Printf("server did not answer %d keepalives, closing the connection", missed)
+
+			c.mu.Lock()
+			if c.sshClient == sshClient {
+				c.unreachable = true
+			}
+			c.mu.Unlock()
+
+			sshClient.Close()
+			return
+		}
+	}
+}
+
+// probe sends a single keepalive and reports whether it was answered within
+// the keepalive interval.
+func (c *Conn) probe(sshClient *ssh.Client) bool {
+	answered := make(chan bool, 1)
+	go func() {
+		_, _, err := sshClient.SendRequest(keepAliveRequest, true, nil)
+		answered <- err == nil
+	}()
+
+	timer := time.NewTimer(c.opts.KeepAliveInterval)
+	defer timer.Stop()
+
+	select {
+	case ok := <-answered:
+		return ok
+	case <-timer.C:
+		return false
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/kevinburke/ssh_config"
+)
+
+// hostConfig holds the connection settings that ssh_config resolved for a
+// host alias. Empty fields mean that the configuration did not set them.
+type hostConfig struct {
+	hostName        string
+	port            int
+	user            string
+	identityFiles   []string
+	knownHostsFiles []string
+	proxyJump       string
+
+	serverAliveInterval time.Duration
+	serverAliveCountMax int
+}
+
+// sshConfig looks up keys in the user configuration first and in the system
+// wide configuration second, the same way ssh does.
+type sshConfig struct {
+	configs []*ssh_config.Config
+}
+
+// loadSSHConfig parses the given ssh_config file. If file is empty,
+// ~/.ssh/config and /etc/ssh/ssh_config are used instead; either of them may
+// be missing, and is skipped if it can't be parsed.
+func loadSSHConfig(file string) (*sshConfig, error) {
+	sc := &sshConfig{}
+
+	if file != "" {
+		cfg, err := decodeSSHConfig(file)
+		if err != nil {
+			return nil, err
+		}
+
+		sc.configs = append(sc.configs, cfg)
+		return sc, nil
+	}
+
+	var files []string
+	if home, err := os.UserHomeDir(); err == nil {
+		files = append(files, filepath.Join(home, ".ssh", "config"))
+	}
+	files = append(files, filepath.Join("/", "etc", "ssh", "ssh_config"))
+
+	for _, file := range files {
+		cfg, err := decodeSSHConfig(file)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			log.Printf("ignoring ssh_config: %v", err)
+			continue
+		}
+
+		sc.configs = append(sc.configs, cfg)
+	}
+
+	return sc, nil
+}
+
+func decodeSSHConfig(file string) (*ssh_config.Config, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	data, skipped := skipMatchBlocks(data)
+	if skipped > 0 {
+		log.Printf("ignoring %d Match blocks in '%s', which are not supported", skipped, file)
+	}
+
+	cfg, err := ssh_config.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse '%s': %v", file, err)
+	}
+
+	return cfg, nil
+}
+
+// skipMatchBlocks removes the Match blocks from an ssh_config file, which the
+// parser rejects altogether. A block ends at the next Host or Match line.
+func skipMatchBlocks(data []byte) ([]byte, int) {
+	var out [][]byte
+	skipped := 0
+	inMatch := false
+
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		fields := strings.FieldsFunc(string(line), func(r rune) bool {
+			return r == '=' || unicode.IsSpace(r)
+		})
+
+		if len(fields) > 0 {
+			switch strings.ToLower(fields[0]) {
+			case "match":
+				inMatch = true
+				skipped++
+			case "host":
+				inMatch = false
+			}
+		}
+
+		if !inMatch {
+			out = append(out, line)
+		}
+	}
+
+	return bytes.Join(out, nil), skipped
+}
+
+func (sc *sshConfig) get(alias, key string) (string, error) {
+	for _, cfg := range sc.configs {
+		val, err := cfg.Get(alias, key)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s for '%s': %v", key, alias, err)
+		}
+
+		if val != "" {
+			return val, nil
+		}
+	}
+
+	return "", nil
+}
+
+func (sc *sshConfig) getAll(alias, key string) ([]string, error) {
+	for _, cfg := range sc.configs {
+		vals, err := cfg.GetAll(alias, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s for '%s': %v", key, alias, err)
+		}
+
+		if len(vals) > 0 {
+			return vals, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// resolve returns the settings configured for alias.
+func (sc *sshConfig) resolve(alias string) (*hostConfig, error) {
+	hc := &hostConfig{}
+
+	var err error
+	if hc.hostName, err = sc.get(alias, "HostName"); err != nil {
+		return nil, err
+	}
+	if hc.hostName == "" {
+		hc.hostName = alias
+	}
+	hc.hostName = strings.ReplaceAll(hc.hostName, "%h", alias)
+
+	port, err := sc.get(alias, "Port")
+	if err != nil {
+		return nil, err
+	}
+	if port != "" {
+		if hc.port, err = strconv.Atoi(port); err != nil {
+			return nil, fmt.Errorf("invalid Port '%s' for '%s'", port, alias)
+		}
+	}
+
+	if hc.user, err = sc.get(alias, "User"); err != nil {
+		return nil, err
+	}
+
+	identityFiles, err := sc.getAll(alias, "IdentityFile")
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range identityFiles {
+		if strings.EqualFold(file, "none") {
+			continue
+		}
+		hc.identityFiles = append(hc.identityFiles, hc.expand(file))
+	}
+
+	knownHosts, err := sc.get(alias, "UserKnownHostsFile")
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range strings.Fields(knownHosts) {
+		if strings.EqualFold(file, "none") {
+			continue
+		}
+		hc.knownHostsFiles = append(hc.knownHostsFiles, hc.expand(file))
+	}
+
+	if hc.proxyJump, err = sc.get(alias, "ProxyJump"); err != nil {
+		return nil, err
+	}
+
+	interval, err := sc.get(alias, "ServerAliveInterval")
+	if err != nil {
+		return nil, err
+	}
+	if interval != "" {
+		seconds, err := strconv.Atoi(interval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ServerAliveInterval '%s' for '%s'", interval, alias)
+		}
+		hc.serverAliveInterval = time.Duration(seconds) * time.Second
+	}
+
+	countMax, err := sc.get(alias, "ServerAliveCountMax")
+	if err != nil {
+		return nil, err
+	}
+	if countMax != "" {
+		if hc.serverAliveCountMax, err = strconv.Atoi(countMax); err != nil {
+			return nil, fmt.Errorf("invalid ServerAliveCountMax '%s' for '%s'", countMax, alias)
+		}
+	}
+
+	return hc, nil
+}
+
+// expand replaces a leading tilde and the %d, %h, %p, %r, %u and %% tokens
+// that ssh_config allows in file names.
+func (hc *hostConfig) expand(s string) string {
+	home, _ := os.UserHomeDir()
+
+	if s == "~" || strings.HasPrefix(s, "~/") {
+		s = home + s[1:]
+	}
+
+	port := hc.port
+	if port == 0 {
+		port = defaultPort
+	}
+
+	localUser := ""
+	if u, err := user.Current(); err == nil {
+		localUser = u.Username
+	}
+
+	replacer := strings.NewReplacer(
+		"%%", "%",
+		"%d", home,
+		"%h", hc.hostName,
+		"%p", strconv.Itoa(port),
+		"%r", hc.user,
+		"%u", localUser,
+	)
+
+	return replacer.Replace(s)
+}
+
+// existingFiles filters out the files that do not exist, since ssh_config
+// commonly lists optional files such as ~/.ssh/known_hosts2.
+func existingFiles(files []string) []string {
+	var existing []string
+	for _, file := range files {
+		if _, err := os.Stat(file); err == nil {
+			existing = append(existing, file)
+		}
+	}
+
+	return existing
+}
@@ -0,0 +1,268 @@
+package xattr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"sftpfs/inode"
+	"sftpfs/remote"
+)
+
+// SidecarName is the hidden file in each directory that holds the attributes
+// of its entries.
+const SidecarName = inode.HiddenPrefix + "xattr.json"
+
+const posixRenameExtension = "posix-rename@openssh.com"
+
+// sidecarTTL is how long a sidecar that was read stays cached, so that
+// repeated lookups (the kernel asks for security.capability on every write)
+// don't go to the server.
+const sidecarTTL = 5 * time.Second
+
+// attrTable maps entry names to their attributes.
+type attrTable map[string]map[string][]byte
+
+type cachedTable struct {
+	attrs  attrTable
+	loaded time.Time
+}
+
+// Sidecar returns a Store that keeps attributes in a JSON file next to the
+// files they belong to. The Store is not safe for concurrent use.
+func Sidecar(conn *remote.Conn) Store {
+	return &sidecar{
+		conn:   conn,
+		tables: make(map[string]*cachedTable),
+	}
+}
+
+type sidecar struct {
+	conn   *remote.Conn
+	tables map[string]*cachedTable
+}
+
+func (s *sidecar) Get(key Key, name string) ([]byte, error) {
+	attrs, err := s.load(key.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	value, ok := attrs[key.Name][name]
+	if !ok {
+		return nil, ErrNoAttr
+	}
+
+	return value, nil
+}
+
+func (s *sidecar) List(key Key) ([]string, error) {
+	attrs, err := s.load(key.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for name := range attrs[key.Name] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (s *sidecar) Set(key Key, name string, value []byte) error {
+	attrs, err := s.load(key.Dir)
+	if err != nil {
+		return err
+	}
+
+	if attrs[key.Name] == nil {
+		attrs[key.Name] = make(map[string][]byte)
+	}
+	// value may point into a buffer that gets reused.
+	attrs[key.Name][name] = append([]byte(nil), value...)
+
+	return s.save(key.Dir, attrs)
+}
+
+func (s *sidecar) Remove(key Key, name string) error {
+	attrs, err := s.load(key.Dir)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := attrs[key.Name][name]; !ok {
+		return ErrNoAttr
+	}
+
+	delete(attrs[key.Name], name)
+	if len(attrs[key.Name]) == 0 {
+		delete(attrs, key.Name)
+	}
+
+	return s.save(key.Dir, attrs)
+}
+
+func (s *sidecar) Move(from, to Key) error {
+	// The attributes of a directory are stored inside it and move with it.
+	if from.Name == "." {
+		return nil
+	}
+
+	fromAttrs, err := s.load(from.Dir)
+	if err != nil {
+		return err
+	}
+
+	toAttrs, err := s.load(to.Dir)
+	if err != nil {
+		return err
+	}
+
+	entry, moving := fromAttrs[from.Name]
+	if _, replacing := toAttrs[to.Name]; !moving && !replacing {
+		return nil
+	}
+
+	delete(fromAttrs, from.Name)
+	if moving {
+		toAttrs[to.Name] = entry
+	} else {
+		delete(toAttrs, to.Name)
+	}
+
+	if from.Dir != to.Dir {
+		if err := s.save(from.Dir, fromAttrs); err != nil {
+			return err
+		}
+	}
+
+	return s.save(to.Dir, toAttrs)
+}
+
+func (s *sidecar) Delete(key Key) error {
+	if key.Name == "." {
+		return s.save(key.Dir, attrTable{})
+	}
+
+	attrs, err := s.load(key.Dir)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := attrs[key.Name]; !ok {
+		return nil
+	}
+
+	delete(attrs, key.Name)
+
+	return s.save(key.Dir, attrs)
+}
+
+// load returns the attributes stored in the sidecar of dir, which is empty
+// if there is no sidecar yet.
+func (s *sidecar) load(dir string) (attrTable, error) {
+	if table, ok := s.tables[dir]; ok && time.Since(table.loaded) < sidecarTTL {
+		return table.attrs, nil
+	}
+
+	client, err := s.conn.Client()
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := make(attrTable)
+
+	sidecarPath := path.Join(dir, SidecarName)
+	f, err := client.Open(sidecarPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to open '%s': %w", sidecarPath, err)
+	}
+	if err == nil {
+		defer f.Close()
+
+		if err := json.NewDecoder(f).Decode(&attrs); err != nil {
+			return nil, fmt.Errorf("failed to parse '%s': %w", sidecarPath, err)
+		}
+	}
+
+	s.expire()
+	s.tables[dir] = &cachedTable{attrs: attrs, loaded: time.Now()}
+
+	return attrs, nil
+}
+
+// save writes attrs to the sidecar of dir. Sidecars without attributes are
+// removed, so that empty directories can be deleted. The new sidecar is
+// written next to the old one and renamed over it, so that a failed write
+// leaves the old attributes alone.
+func (s *sidecar) save(dir string, attrs attrTable) error {
+	client, err := s.conn.Client()
+	if err != nil {
+		return err
+	}
+
+	// Whatever happens, the cached copy may no longer match the server.
+	delete(s.tables, dir)
+
+	sidecarPath := path.Join(dir, SidecarName)
+	if len(attrs) == 0 {
+		if err := client.Remove(sidecarPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove '%s': %w", sidecarPath, err)
+		}
+
+		return nil
+	}
+
+	data, err := json.Marshal(attrs)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := fmt.Sprintf("%s.%d", sidecarPath, time.Now().UnixNano())
+	f, err := client.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return fmt.Errorf("failed to open '%s': %w", tmpPath, err)
+	}
+
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		client.Remove(tmpPath)
+		return fmt.Errorf("failed to write '%s': %w", tmpPath, err)
+	}
+
+	if _, ok := client.HasExtension(posixRenameExtension); ok {
+		err = client.PosixRename(tmpPath, sidecarPath)
+	} else {
+		// Plain SFTP renames don't replace files.
+		err = client.Remove(sidecarPath)
+		if err == nil || errors.Is(err, os.ErrNotExist) {
+			err = client.Rename(tmpPath, sidecarPath)
+		}
+	}
+	if err != nil {
+		client.Remove(tmpPath)
+		return fmt.Errorf("failed to replace '%s': %w", sidecarPath, err)
+	}
+
+	s.tables[dir] = &cachedTable{attrs: attrs, loaded: time.Now()}
+
+	return nil
+}
+
+// expire drops the cached sidecars that are too old to be used.
+func (s *sidecar) expire() {
+	for dir, table := range s.tables {
+		if time.Since(table.loaded) >= sidecarTTL {
+			delete(s.tables, dir)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package xattr
+
+import (
+	"errors"
+	"path"
+)
+
+// ErrNoAttr is returned for attributes that aren't set.
+var ErrNoAttr = errors.New("no such attribute")
+
+// ErrUnsupported is returned by stores that can't keep attributes at all.
+var ErrUnsupported = errors.New("extended attributes not supported")
+
+// Key locates the attributes of a file: Name is the entry in directory Dir
+// they belong to. A directory keeps its own attributes under the name ".",
+// so that they move along with it.
+type Key struct {
+	Dir  string
+	Name string
+}
+
+// FileKey returns the key of the non-directory at remotePath.
+func FileKey(remotePath string) Key {
+	return Key{Dir: path.Dir(remotePath), Name: path.Base(remotePath)}
+}
+
+// DirKey returns the key of the directory at remotePath.
+func DirKey(remotePath string) Key {
+	return Key{Dir: remotePath, Name: "."}
+}
+
+// Store keeps the extended attributes of remote files, since SFTP has no
+// notion of them. Attributes belong to a name, so hard links don't share
+// them.
+type Store interface {
+	Get(key Key, name string) ([]byte, error)
+	List(key Key) ([]string, error)
+	Set(key Key, name string, value []byte) error
+	Remove(key Key, name string) error
+
+	// Move carries the attributes of a renamed file over to its new key,
+	// replacing whatever was stored there.
+	Move(from, to Key) error
+
+	// Delete drops all attributes of a file. For a directory key this
+	// includes the attributes of its entries.
+	Delete(key Key) error
+}
+
+// None returns a Store that supports no attributes.
+func None() Store {
+	return none{}
+}
+
+type none struct{}
+
+func (none) Get(Key, string) ([]byte, error) { return nil, ErrUnsupported }
+func (none) List(Key) ([]string, error)      { return nil, ErrUnsupported }
+func (none) Set(Key, string, []byte) error   { return ErrUnsupported }
+func (none) Remove(Key, string) error        { return ErrUnsupported }
+func (none) Move(Key, Key) error             { return nil }
+func (none) Delete(Key) error                { return nil }